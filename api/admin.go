@@ -0,0 +1,262 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/adapter"
+	"github.com/zhu327/gemini-openai-proxy/pkg/breaker"
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+// adminToken protects the /admin routes, they are not registered when it is empty
+var adminToken = util.GetEnvString("ADMIN_TOKEN", "")
+
+// AdminAuth only lets requests carrying the admin token through, client API keys are never accepted
+func AdminAuth(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, openai.APIError{
+			Code:    http.StatusUnauthorized,
+			Message: "invalid admin token",
+			Type:    "invalid_request_error",
+		})
+		return
+	}
+	c.Next()
+}
+
+type disableRequest struct {
+	Duration string `json:"duration"`
+}
+
+// AdminConfigHandler shows the active configuration and model routes, secrets are left out
+func AdminConfigHandler(c *gin.Context) {
+	routes := map[string]string{}
+	for _, model := range []string{
+		openai.GPT3Dot5Turbo,
+		openai.GPT4,
+		openai.GPT4TurboPreview,
+		openai.GPT4VisionPreview,
+		openai.GPT4o,
+		string(openai.AdaEmbeddingV2),
+		string(openai.SmallEmbedding3),
+		string(openai.LargeEmbedding3),
+	} {
+		req := &adapter.ChatCompletionRequest{Model: model}
+		routes[model] = req.ParseModelWithMapping()
+	}
+
+	retryPolicies := gin.H{}
+	for model, policy := range adapter.RetryPolicies() {
+		retryPolicies[model] = gin.H{
+			"max_retries":   policy.MaxRetries,
+			"initial_delay": policy.InitialDelay.String(),
+			"max_delay":     policy.MaxDelay.String(),
+			"deadline":      policy.Deadline.String(),
+		}
+	}
+
+	chunking := gin.H{}
+	for model, cfg := range adapter.ChunkingConfigs() {
+		chunking[model] = gin.H{
+			"strategy": cfg.Strategy,
+			"window":   cfg.Window.String(),
+			"bytes":    cfg.Bytes,
+		}
+	}
+
+	fallbacks, fallbackRules := adapter.ModelFallbacks()
+	breakerConfig := adapter.Breakers().Config()
+
+	c.JSON(http.StatusOK, gin.H{
+		"model_mapping": gin.H{
+			"enabled": adapter.USE_MODEL_MAPPING,
+			"routes":  routes,
+		},
+		"models":          adapter.GetAvailableGeminiModels(),
+		"retry_policies":  retryPolicies,
+		"stream_chunking": chunking,
+		"fallbacks": gin.H{
+			"models": fallbacks,
+			"on":     fallbackRules,
+		},
+		"circuit_breaker": gin.H{
+			"enabled":            breakerConfig.Enabled,
+			"window":             breakerConfig.Window.String(),
+			"min_requests":       breakerConfig.MinRequests,
+			"error_rate":         breakerConfig.ErrorRate,
+			"slow_call":          breakerConfig.SlowCall.String(),
+			"open_duration":      breakerConfig.OpenDuration.String(),
+			"half_open_requests": breakerConfig.HalfOpenRequests,
+			"idle_ttl":           breakerConfig.IdleTTL.String(),
+		},
+		"response_cache": gin.H{
+			"backend":     cacheConfig.Backend,
+			"ttl":         cacheConfig.TTL.String(),
+			"max_entries": cacheConfig.MaxEntries,
+			"dir":         cacheConfig.Dir,
+		},
+		"semantic_cache": gin.H{
+			"enabled":         semanticConfig.Enabled,
+			"threshold":       semanticConfig.Threshold,
+			"scope":           semanticConfig.Scope,
+			"eviction":        semanticConfig.Eviction,
+			"max_entries":     semanticConfig.MaxEntries,
+			"ttl":             semanticConfig.TTL.String(),
+			"embedding_model": semanticConfig.EmbeddingModel,
+		},
+		"health_check": gin.H{
+			"api_key_set":          healthCheckAPIKey != "",
+			"cache_ttl":            healthCheckCacheTTL.String(),
+			"ready_open_key_ratio": readyOpenKeyRatio,
+		},
+		"disabled_models": adapter.DisabledModels(),
+		"config_errors":   util.ConfigErrors(),
+	})
+}
+
+// AdminKeysHandler lists every upstream key seen so far with its circuits, cooldowns and disabled state
+func AdminKeysHandler(c *gin.Context) {
+	type keyHealth struct {
+		KeyID         string           `json:"key_id"`
+		Disabled      bool             `json:"disabled"`
+		DisabledUntil *time.Time       `json:"disabled_until,omitempty"`
+		Circuits      []breaker.Status `json:"circuits"`
+	}
+
+	keys := map[string]*keyHealth{}
+	get := func(keyID string) *keyHealth {
+		if _, ok := keys[keyID]; !ok {
+			keys[keyID] = &keyHealth{KeyID: keyID, Circuits: []breaker.Status{}}
+		}
+		return keys[keyID]
+	}
+
+	for _, status := range adapter.Breakers().Statuses() {
+		k := get(status.KeyID)
+		k.Circuits = append(k.Circuits, status)
+	}
+	for keyID, until := range adapter.DisabledKeys() {
+		k := get(keyID)
+		k.Disabled = true
+		if !until.IsZero() {
+			until := until
+			k.DisabledUntil = &until
+		}
+	}
+
+	result := make([]*keyHealth, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, k)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].KeyID < result[j].KeyID })
+
+	c.JSON(http.StatusOK, gin.H{"keys": result})
+}
+
+// AdminFlushCacheHandler empties the exact and semantic response caches
+func AdminFlushCacheHandler(c *gin.Context) {
+	if responseCache != nil {
+		responseCache.Flush()
+	}
+	semanticIndex.Flush()
+	c.JSON(http.StatusOK, gin.H{"flushed": true})
+}
+
+// AdminRefreshModelsHandler fetches the Gemini model catalog again, using the key from the
+// request body or HEALTH_CHECK_API_KEY
+func AdminRefreshModelsHandler(c *gin.Context) {
+	var body struct {
+		APIKey string `json:"api_key"`
+	}
+	_ = c.ShouldBindJSON(&body)
+
+	apiKey := body.APIKey
+	if apiKey == "" {
+		apiKey = healthCheckAPIKey
+	}
+	if apiKey == "" {
+		c.JSON(http.StatusBadRequest, openai.APIError{
+			Code:    http.StatusBadRequest,
+			Message: "api_key is required when HEALTH_CHECK_API_KEY is not set",
+			Type:    "invalid_request_error",
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	models, err := adapter.RefreshGeminiModels(ctx, apiKey)
+	if err != nil {
+		handleGenerateContentError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
+
+// AdminStreamsHandler shows the number of streams currently being relayed
+func AdminStreamsHandler(c *gin.Context) {
+	total, byModel := liveStreams.snapshot()
+	c.JSON(http.StatusOK, gin.H{
+		"total":    total,
+		"by_model": byModel,
+	})
+}
+
+// AdminDisableModelHandler disables a Gemini model, optionally for a duration such as {"duration":"10m"}
+func AdminDisableModelHandler(c *gin.Context) {
+	d, ok := parseDisableDuration(c)
+	if !ok {
+		return
+	}
+	adapter.DisableModel(c.Param("model"), d)
+	c.JSON(http.StatusOK, gin.H{"disabled_models": adapter.DisabledModels()})
+}
+
+func AdminEnableModelHandler(c *gin.Context) {
+	adapter.EnableModel(c.Param("model"))
+	c.JSON(http.StatusOK, gin.H{"disabled_models": adapter.DisabledModels()})
+}
+
+// AdminDisableKeyHandler disables an upstream key by the key_id shown in /admin/keys
+func AdminDisableKeyHandler(c *gin.Context) {
+	d, ok := parseDisableDuration(c)
+	if !ok {
+		return
+	}
+	adapter.DisableKey(c.Param("key"), d)
+	c.JSON(http.StatusOK, gin.H{"disabled_keys": adapter.DisabledKeys()})
+}
+
+func AdminEnableKeyHandler(c *gin.Context) {
+	adapter.EnableKey(c.Param("key"))
+	c.JSON(http.StatusOK, gin.H{"disabled_keys": adapter.DisabledKeys()})
+}
+
+func parseDisableDuration(c *gin.Context) (time.Duration, bool) {
+	var req disableRequest
+	_ = c.ShouldBindJSON(&req)
+	if req.Duration == "" {
+		return 0, true
+	}
+
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d < 0 {
+		c.JSON(http.StatusBadRequest, openai.APIError{
+			Code:    http.StatusBadRequest,
+			Message: "invalid duration " + req.Duration,
+			Type:    "invalid_request_error",
+		})
+		return 0, false
+	}
+	return d, true
+}
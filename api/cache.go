@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/adapter"
+	"github.com/zhu327/gemini-openai-proxy/pkg/cache"
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+const (
+	cacheBypassHeader = "X-Cache-Bypass"
+	cacheStatusHeader = "X-Cache"
+
+	cacheStatusHit    = "HIT"
+	cacheStatusMiss   = "MISS"
+	cacheStatusBypass = "BYPASS"
+)
+
+var (
+	cacheConfig   = cache.ConfigFromEnv()
+	responseCache = cache.New(cacheConfig)
+)
+
+// cacheBypassed reports whether the client asked to skip all response caches
+func cacheBypassed(c *gin.Context) bool {
+	switch strings.ToLower(c.GetHeader(cacheBypassHeader)) {
+	case "1", "true", "yes":
+		c.Header(cacheStatusHeader, cacheStatusBypass)
+		return true
+	}
+	return false
+}
+
+// cacheEnabled reports whether the response cache should be consulted for this request
+func cacheEnabled(c *gin.Context) bool {
+	return responseCache != nil && !cacheBypassed(c)
+}
+
+// tenantID returns a hash of the API key so cached entries are never shared between keys
+func tenantID(apiKey string) string {
+	return util.HashKey(apiKey)
+}
+
+func chatCacheKey(apiKey, model string, req *adapter.ChatCompletionRequest) string {
+	kind := "chat"
+	if req.Stream {
+		kind = "chat-stream"
+	}
+	return cache.Key(kind, tenantID(apiKey), model, req)
+}
+
+func embeddingCacheKey(apiKey, model string, req *adapter.EmbeddingRequest) string {
+	return cache.Key("embedding", tenantID(apiKey), model, req)
+}
+
+// getCachedJSON loads a cached response into v and marks the response as a cache hit
+func getCachedJSON(c *gin.Context, key string, v any) bool {
+	data, ok := responseCache.Get(key)
+	if !ok || json.Unmarshal(data, v) != nil {
+		c.Header(cacheStatusHeader, cacheStatusMiss)
+		return false
+	}
+	c.Header(cacheStatusHeader, cacheStatusHit)
+	return true
+}
+
+func setCachedJSON(key string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	responseCache.Set(key, data, cacheConfig.TTL)
+}
+
+// streamRecorder collects the chunks of a stream so a complete, error free stream can be cached
+type streamRecorder struct {
+	key      string
+	semantic *semanticMatch
+	chunks   []string
+	failed   bool
+}
+
+func newStreamRecorder(key string, semantic *semanticMatch) *streamRecorder {
+	if key == "" && semantic == nil {
+		return nil
+	}
+	return &streamRecorder{key: key, semantic: semantic}
+}
+
+func (r *streamRecorder) record(data string) {
+	if r == nil || r.failed {
+		return
+	}
+
+	// Streams that sent an error event are not cacheable, only completion chunks are
+	var chunk adapter.CompletionResponse
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil || chunk.Object != "chat.completion.chunk" {
+		r.failed = true
+		r.chunks = nil
+		return
+	}
+	r.chunks = append(r.chunks, data)
+}
+
+func (r *streamRecorder) save() {
+	if r == nil || r.failed || len(r.chunks) == 0 {
+		return
+	}
+	if r.key != "" {
+		setCachedJSON(r.key, r.chunks)
+	}
+	r.semantic.store(r.chunks)
+}
@@ -1,10 +1,14 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/generative-ai-go/genai"
@@ -14,6 +18,7 @@ import (
 	"google.golang.org/api/option"
 
 	"github.com/zhu327/gemini-openai-proxy/pkg/adapter"
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
 )
 
 func IndexHandler(c *gin.Context) {
@@ -95,6 +100,18 @@ func ModelListHandler(c *gin.Context) {
 				Object:    "model",
 				OwnedBy:   owner,
 			},
+			openai.Model{
+				CreatedAt: 1686935002,
+				ID:        adapter.GetModel(string(openai.SmallEmbedding3)),
+				Object:    "model",
+				OwnedBy:   owner,
+			},
+			openai.Model{
+				CreatedAt: 1686935002,
+				ID:        adapter.GetModel(string(openai.LargeEmbedding3)),
+				Object:    "model",
+				OwnedBy:   owner,
+			},
 			openai.Model{
 				CreatedAt: 1686935002,
 				ID:        adapter.GetModel(openai.GPT4o),
@@ -149,7 +166,7 @@ func ChatProxyHandler(c *gin.Context) {
 		return
 	}
 
-	messages, err := req.ToGenaiMessages()
+	messages, err := req.ToGenaiMessages(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusBadRequest, openai.APIError{
 			Code:    http.StatusBadRequest,
@@ -158,6 +175,27 @@ func ChatProxyHandler(c *gin.Context) {
 		return
 	}
 
+	model := req.ToGenaiModel()
+
+	// Cache hits are answered before any upstream client is created, so they never consume Gemini quota
+	var cacheKey string
+	if cacheEnabled(c) {
+		cacheKey = chatCacheKey(openaiAPIKey, model, req)
+		if req.Stream {
+			var chunks []string
+			if getCachedJSON(c, cacheKey, &chunks) {
+				replayStream(c, chunks)
+				return
+			}
+		} else {
+			resp := &openai.ChatCompletionResponse{}
+			if getCachedJSON(c, cacheKey, resp) {
+				c.JSON(http.StatusOK, resp)
+				return
+			}
+		}
+	}
+
 	ctx := c.Request.Context()
 	client, err := genai.NewClient(ctx, option.WithAPIKey(openaiAPIKey))
 	if err != nil {
@@ -168,35 +206,161 @@ func ChatProxyHandler(c *gin.Context) {
 		})
 		return
 	}
-	defer client.Close()
+	// A resumable stream outlives the handler, its session takes the client over
+	sessionOwnsClient := false
+	defer func() {
+		if !sessionOwnsClient {
+			client.Close()
+		}
+	}()
+
+	cached, semantic := lookupSemanticCache(ctx, c, client, openaiAPIKey, model, req)
+	if cached != nil {
+		if req.Stream {
+			var chunks []string
+			if err := json.Unmarshal(cached, &chunks); err == nil {
+				replayStream(c, chunks)
+				return
+			}
+		} else {
+			c.Data(http.StatusOK, "application/json; charset=utf-8", cached)
+			return
+		}
+	}
 
-	model := req.ToGenaiModel()
-	gemini := adapter.NewGeminiAdapter(client, model)
+	gemini := adapter.NewGeminiAdapter(client, util.HashKey(openaiAPIKey), model)
+
+	hb := &heartbeat{c: c}
 
 	if !req.Stream {
-		resp, err := gemini.GenerateContent(ctx, req, messages)
-		if err != nil {
-			handleGenerateContentError(c, err)
-			return
+		var resp *openai.ChatCompletionResponse
+		awaitUpstream(trickleInterval, func() {
+			resp, err = gemini.GenerateContent(ctx, req, messages)
+		}, hb.trickle)
+
+		if hb.committed {
+			// The headers are gone already, so errors are reported in the body
+			if err != nil {
+				hb.writeError(err)
+				return
+			}
+		} else {
+			setUpstreamHeaders(c, gemini)
+			if err != nil {
+				handleGenerateContentError(c, err)
+				return
+			}
 		}
 
+		if cacheKey != "" {
+			setCachedJSON(cacheKey, resp)
+		}
+		semantic.store(resp)
+		if hb.committed {
+			hb.writeJSON(resp)
+			return
+		}
 		c.JSON(http.StatusOK, resp)
 		return
 	}
 
-	dataChan, err := gemini.GenerateStreamContent(ctx, req, messages)
+	// Returning from the handler stops the upstream stream even if the client is still connected,
+	// unless the stream is resumable and its session decides when to stop it
+	parentCtx := ctx
+	if streamResume {
+		parentCtx = context.WithoutCancel(ctx)
+	}
+	streamCtx, cancel := context.WithCancel(parentCtx)
+	resumable := false
+	defer func() {
+		if !resumable {
+			cancel()
+		}
+	}()
+
+	var dataChan <-chan string
+	awaitUpstream(sseKeepaliveInterval, func() {
+		dataChan, err = gemini.GenerateStreamContent(streamCtx, req, messages)
+	}, hb.sse)
+
+	if !hb.committed {
+		setUpstreamHeaders(c, gemini)
+	}
 	if err != nil {
+		if hb.committed {
+			// The stream has started with keepalives, so the error is sent as an event
+			_, apiErr := errorResponse(err)
+			data, _ := json.Marshal(adapter.ErrorResponse{Error: apiErr})
+			c.Render(-1, adapter.Event{Data: string(data)})
+			c.Render(-1, adapter.Event{Data: "[DONE]"})
+			return
+		}
 		handleGenerateContentError(c, err)
 		return
 	}
 
+	recorder := newStreamRecorder(cacheKey, semantic)
+	done := liveStreams.start(gemini.ModelUsed())
+
+	if streamResume {
+		resumable = true
+		sessionOwnsClient = true
+		session := newStreamSession(util.HashKey(openaiAPIKey), cancel, client)
+		go session.pump(streamCtx, dataChan, recorder, done)
+		session.follow(c, 0)
+		return
+	}
+	defer done()
+
+	// Keepalives continue while upstream is silent, such as when a model is thinking
+	var (
+		ticker    *time.Ticker
+		keepalive <-chan time.Time
+	)
+	if sseKeepaliveInterval > 0 {
+		ticker = time.NewTicker(sseKeepaliveInterval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
 	setEventStreamHeaders(c)
 	c.Stream(func(w io.Writer) bool {
-		if data, ok := <-dataChan; ok {
-			c.Render(-1, adapter.Event{Data: "data: " + data})
+		var (
+			data string
+			ok   bool
+		)
+		select {
+		case data, ok = <-dataChan:
+		case <-keepalive:
+			c.Render(-1, adapter.Event{Comment: "keepalive"})
 			return true
+		case <-streamCtx.Done():
+			// The client disconnected, the relay stops on the same context
+			return false
 		}
-		c.Render(-1, adapter.Event{Data: "data: [DONE]"})
+
+		if ok {
+			if ticker != nil {
+				ticker.Reset(sseKeepaliveInterval)
+			}
+			recorder.record(data)
+			c.Render(-1, adapter.Event{Data: data})
+			return true
+		}
+		recorder.save()
+		c.Render(-1, adapter.Event{Data: "[DONE]"})
+		return false
+	})
+}
+
+// replayStream writes cached stream chunks back as server-sent events
+func replayStream(c *gin.Context, chunks []string) {
+	setEventStreamHeaders(c)
+	c.Stream(func(w io.Writer) bool {
+		for _, data := range chunks {
+			c.Render(-1, adapter.Event{Data: data})
+		}
+		c.Render(-1, adapter.Event{Data: "[DONE]"})
 		return false
 	})
 }
@@ -204,6 +368,12 @@ func ChatProxyHandler(c *gin.Context) {
 func handleGenerateContentError(c *gin.Context, err error) {
 	log.Printf("genai generate content error %v\n", err)
 
+	statusCode, apiErr := errorResponse(err)
+	c.AbortWithStatusJSON(statusCode, apiErr)
+}
+
+// errorResponse converts an error into the status code and OpenAI error sent to the client
+func errorResponse(err error) (int, *openai.APIError) {
 	// Try OpenAI API error first
 	var openaiErr *openai.APIError
 	if errors.As(err, &openaiErr) {
@@ -214,8 +384,7 @@ func handleGenerateContentError(c *gin.Context, err error) {
 			statusCode = code
 		}
 
-		c.AbortWithStatusJSON(statusCode, openaiErr)
-		return
+		return statusCode, openaiErr
 	}
 
 	// Try Google API error
@@ -224,29 +393,41 @@ func handleGenerateContentError(c *gin.Context, err error) {
 		log.Printf("Handling Google API error with code: %d\n", googleErr.Code)
 		statusCode := googleErr.Code
 		if statusCode == http.StatusTooManyRequests {
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, openai.APIError{
+			return http.StatusTooManyRequests, &openai.APIError{
 				Code:    http.StatusTooManyRequests,
 				Message: "Rate limit exceeded",
 				Type:    "rate_limit_error",
-			})
-			return
+			}
 		}
 
-		c.AbortWithStatusJSON(statusCode, openai.APIError{
+		return statusCode, &openai.APIError{
 			Code:    statusCode,
 			Message: googleErr.Message,
 			Type:    "server_error",
-		})
-		return
+		}
+	}
+
+	// The request deadline of the retry policy ran out
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout, &openai.APIError{
+			Code:    http.StatusGatewayTimeout,
+			Message: "upstream request deadline exceeded",
+			Type:    "server_error",
+		}
 	}
 
 	// For all other errors
 	log.Printf("Handling unknown error: %v\n", err)
-	c.AbortWithStatusJSON(http.StatusInternalServerError, openai.APIError{
+	return http.StatusInternalServerError, &openai.APIError{
 		Code:    http.StatusInternalServerError,
 		Message: err.Error(),
 		Type:    "server_error",
-	})
+	}
+}
+
+func setUpstreamHeaders(c *gin.Context, gemini *adapter.GeminiAdapter) {
+	c.Header("X-Retry-Count", strconv.Itoa(gemini.Retries()))
+	c.Header("X-Gemini-Model", gemini.ModelUsed())
 }
 
 func setEventStreamHeaders(c *gin.Context) {
@@ -288,6 +469,27 @@ func EmbeddingProxyHandler(c *gin.Context) {
 		return
 	}
 
+	opts, err := req.Options()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, openai.APIError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	model := req.ToGenaiModel()
+
+	var cacheKey string
+	if cacheEnabled(c) {
+		cacheKey = embeddingCacheKey(openaiAPIKey, model, req)
+		resp := &openai.EmbeddingResponse{}
+		if getCachedJSON(c, cacheKey, resp) {
+			writeEmbeddingResponse(c, req, resp)
+			return
+		}
+	}
+
 	ctx := c.Request.Context()
 	client, err := genai.NewClient(ctx, option.WithAPIKey(openaiAPIKey))
 	if err != nil {
@@ -300,14 +502,30 @@ func EmbeddingProxyHandler(c *gin.Context) {
 	}
 	defer client.Close()
 
-	model := req.ToGenaiModel()
-	gemini := adapter.NewGeminiAdapter(client, model)
+	gemini := adapter.NewGeminiAdapter(client, util.HashKey(openaiAPIKey), model)
 
-	resp, err := gemini.GenerateEmbedding(ctx, messages)
+	resp, err := gemini.GenerateEmbedding(ctx, messages, opts)
 	if err != nil {
 		handleGenerateContentError(c, err)
 		return
 	}
 
+	if cacheKey != "" {
+		setCachedJSON(cacheKey, resp)
+	}
+	writeEmbeddingResponse(c, req, resp)
+}
+
+// writeEmbeddingResponse sends the embeddings in the requested encoding_format
+func writeEmbeddingResponse(c *gin.Context, req *adapter.EmbeddingRequest, resp *openai.EmbeddingResponse) {
+	// Clients get back the OpenAI model name they asked for
+	if adapter.USE_MODEL_MAPPING {
+		resp.Model = openai.EmbeddingModel(req.Model)
+	}
+
+	if req.EncodingFormat == openai.EmbeddingEncodingFormatBase64 {
+		c.JSON(http.StatusOK, adapter.EncodeEmbeddingsBase64(resp))
+		return
+	}
 	c.JSON(http.StatusOK, resp)
 }
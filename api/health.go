@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/adapter"
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+var (
+	// healthCheckAPIKey is a server side key used by the deep readiness check, it is never taken from clients
+	healthCheckAPIKey   = util.GetEnvString("HEALTH_CHECK_API_KEY", "")
+	healthCheckCacheTTL = util.GetEnvDuration("HEALTH_CHECK_CACHE_TTL", 30*time.Second)
+	healthCheckTimeout  = util.GetEnvDuration("HEALTH_CHECK_TIMEOUT", 5*time.Second)
+	// readyOpenKeyRatio is the share of upstream keys with every circuit open at which the
+	// instance reports unready, when no HEALTH_CHECK_API_KEY is set
+	readyOpenKeyRatio = util.GetEnvFloat("READYZ_OPEN_KEY_RATIO", 1)
+
+	deepCheckLock    sync.Mutex
+	deepCheckAt      time.Time
+	deepCheckLastErr error
+)
+
+// HealthzHandler is the liveness probe, it succeeds as long as the process can serve requests
+func HealthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadyzHandler is the readiness probe. It fails while the configuration is invalid or the upstream
+// keys have their circuits open, see circuitsUnready. With ?deep=1 it also checks Gemini using
+// HEALTH_CHECK_API_KEY.
+func ReadyzHandler(c *gin.Context) {
+	checks := gin.H{}
+	ready := true
+
+	if errs := util.ConfigErrors(); len(errs) > 0 {
+		checks["config"] = errs
+		ready = false
+	} else {
+		checks["config"] = "ok"
+	}
+
+	if reason := circuitsUnready(); reason != "" {
+		checks["circuit_breakers"] = reason
+		ready = false
+	} else {
+		checks["circuit_breakers"] = "ok"
+	}
+
+	if deep := c.Query("deep"); deep == "1" || deep == "true" {
+		if healthCheckAPIKey == "" {
+			checks["upstream"] = "skipped, HEALTH_CHECK_API_KEY is not set"
+		} else if err := deepCheck(c.Request.Context()); err != nil {
+			checks["upstream"] = err.Error()
+			ready = false
+		} else {
+			checks["upstream"] = "ok"
+		}
+	}
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+// minReadyKeys is how many keys must be known before their circuits affect readiness without
+// HEALTH_CHECK_API_KEY, so a single client running out of quota cannot take the instance out of rotation
+const minReadyKeys = 2
+
+// circuitsUnready explains why the circuits make the instance unready, or returns "". Breakers belong to
+// client keys, so only the server's own HEALTH_CHECK_API_KEY is checked when it is set. Otherwise the
+// share of keys with every circuit open is compared to READYZ_OPEN_KEY_RATIO. Keys disabled by an
+// admin are ignored either way.
+func circuitsUnready() string {
+	if healthCheckAPIKey != "" {
+		healthKeyID := util.HashKey(healthCheckAPIKey)
+		open, _ := adapter.Breakers().OpenKeys(func(keyID string) bool {
+			return keyID == healthKeyID && !adapter.IsKeyDisabled(keyID)
+		})
+		if open > 0 {
+			return "all circuits of HEALTH_CHECK_API_KEY are open"
+		}
+		return ""
+	}
+
+	open, total := adapter.Breakers().OpenKeys(func(keyID string) bool {
+		return !adapter.IsKeyDisabled(keyID)
+	})
+	if total >= minReadyKeys && float64(open) >= readyOpenKeyRatio*float64(total) {
+		return fmt.Sprintf("%d of %d keys have every circuit open", open, total)
+	}
+	return ""
+}
+
+// deepCheck pings Gemini, reusing the last result for HEALTH_CHECK_CACHE_TTL so probes stay cheap
+func deepCheck(ctx context.Context) error {
+	deepCheckLock.Lock()
+	defer deepCheckLock.Unlock()
+
+	if !deepCheckAt.IsZero() && time.Since(deepCheckAt) < healthCheckCacheTTL {
+		return deepCheckLastErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	deepCheckLastErr = adapter.PingGemini(ctx, healthCheckAPIKey)
+	deepCheckAt = time.Now()
+	return deepCheckLastErr
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/adapter"
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+var (
+	// sseKeepaliveInterval is how often a comment is sent on a stream that is waiting for upstream, 0 disables it
+	sseKeepaliveInterval = util.GetEnvDuration("SSE_KEEPALIVE_INTERVAL", 15*time.Second)
+	// trickleInterval is how often a non-streaming response that is waiting for upstream sends
+	// a space before its JSON body, 0 disables it
+	trickleInterval = util.GetEnvDuration("TRICKLE_INTERVAL", 0)
+)
+
+// awaitUpstream runs call in the background and calls beat every interval until it returns.
+// beat runs on the calling goroutine, so it may write to the response.
+func awaitUpstream(interval time.Duration, call func(), beat func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		call()
+	}()
+
+	if interval <= 0 {
+		<-done
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			beat()
+		}
+	}
+}
+
+// heartbeat keeps a response alive while it waits for upstream. The status and headers are sent
+// with the first beat, after that errors can only be reported in the body.
+type heartbeat struct {
+	c         *gin.Context
+	committed bool
+}
+
+// sse sends a keepalive comment on an event stream
+func (h *heartbeat) sse() {
+	if !h.committed {
+		setEventStreamHeaders(h.c)
+		h.c.Status(http.StatusOK)
+		h.committed = true
+	}
+	h.c.Render(-1, adapter.Event{Comment: "keepalive"})
+	h.c.Writer.Flush()
+}
+
+// trickle sends a space ahead of a JSON body, which JSON parsers skip
+func (h *heartbeat) trickle() {
+	if !h.committed {
+		h.c.Header("Content-Type", "application/json; charset=utf-8")
+		h.c.Status(http.StatusOK)
+		h.committed = true
+	}
+	_, _ = h.c.Writer.WriteString(" ")
+	h.c.Writer.Flush()
+}
+
+// writeJSON finishes a trickled response, whose status was already sent
+func (h *heartbeat) writeJSON(v any) {
+	body, _ := json.Marshal(v)
+	_, _ = h.c.Writer.Write(body)
+}
+
+// writeError finishes a trickled response with err. The status is already 200, so the error is sent
+// as {"error":{...}} like the errors of event streams.
+func (h *heartbeat) writeError(err error) {
+	_, apiErr := errorResponse(err)
+	h.writeJSON(adapter.ErrorResponse{Error: apiErr})
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+)
+
+func TestTrickledErrorIsSentInErrorEnvelope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	hb := &heartbeat{c: c}
+
+	// Upstream fails only after a few trickle beats were sent
+	var err error
+	awaitUpstream(5*time.Millisecond, func() {
+		time.Sleep(50 * time.Millisecond)
+		err = &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "model overloaded"}
+	}, hb.trickle)
+
+	if !hb.committed {
+		t.Fatal("no trickle beat was sent before upstream failed")
+	}
+	hb.writeError(err)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, a trickled response keeps the 200 it started with", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, " ") {
+		t.Fatalf("body %q does not start with the trickled spaces", body)
+	}
+
+	var resp struct {
+		Error *openai.APIError `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &resp); err != nil {
+		t.Fatalf("body %q is not JSON: %v", body, err)
+	}
+	if resp.Error == nil || resp.Error.Message != "model overloaded" {
+		t.Fatalf("body %q does not carry the upstream error in an error envelope", body)
+	}
+}
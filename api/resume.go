@@ -0,0 +1,280 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/adapter"
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+var (
+	// streamResume keeps streams running after a disconnect so clients can resume them with Last-Event-ID
+	streamResume = util.GetEnvBool("STREAM_RESUME", false)
+	// streamResumeBuffer is how many events of a stream are kept for replay
+	streamResumeBuffer = util.GetEnvInt("STREAM_RESUME_BUFFER", 2000)
+	// streamResumeGrace is how long a stream keeps generating without a connected client
+	streamResumeGrace = util.GetEnvDuration("STREAM_RESUME_GRACE", 30*time.Second)
+	// streamResumeTTL is how long a finished stream can still be replayed
+	streamResumeTTL = util.GetEnvDuration("STREAM_RESUME_TTL", 5*time.Minute)
+	// streamResumeMax bounds the number of resumable streams kept at once
+	streamResumeMax = util.GetEnvInt("STREAM_RESUME_MAX_STREAMS", 1000)
+
+	streamSessions = &sessionRegistry{sessions: map[string]*streamSession{}}
+)
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*streamSession
+}
+
+// add registers a session under its completion ID, it returns false when the registry is full
+func (r *sessionRegistry) add(id string, s *streamSession) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.sessions) >= streamResumeMax {
+		return false
+	}
+	r.sessions[id] = s
+	return true
+}
+
+func (r *sessionRegistry) get(id string) *streamSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+func (r *sessionRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+// streamSession buffers the events of one completion, so its generation is independent of the
+// client connections following it. Event sequence numbers start at 1 and are sent as SSE ids.
+type streamSession struct {
+	tenant string
+	cancel context.CancelFunc
+	client *genai.Client // Owned by the session, closed once the stream has ended
+
+	mu        sync.Mutex
+	events    []string
+	first     int           // Sequence number of events[0]
+	done      bool          // The upstream stream has ended
+	changed   chan struct{} // Closed and replaced whenever an event is added or the stream ends
+	followers int
+}
+
+func newStreamSession(tenant string, cancel context.CancelFunc, client *genai.Client) *streamSession {
+	return &streamSession{
+		tenant:  tenant,
+		cancel:  cancel,
+		client:  client,
+		first:   1,
+		changed: make(chan struct{}),
+	}
+}
+
+// pump moves the upstream events into the buffer until the stream ends. The session is
+// registered for resuming under the completion ID of its first chunk.
+func (s *streamSession) pump(ctx context.Context, dataChan <-chan string, recorder *streamRecorder, done func()) {
+	// The relay reads upstream and deletes the request's File API uploads with the client until it
+	// closes dataChan, so the client is closed only once the stream has ended
+	defer s.client.Close()
+	defer done()
+	defer s.cancel()
+
+	var id string
+	for data := range dataChan {
+		if id == "" {
+			var chunk adapter.CompletionResponse
+			if err := json.Unmarshal([]byte(data), &chunk); err == nil && chunk.ID != "" {
+				id = chunk.ID
+				if !streamSessions.add(id, s) {
+					log.Printf("too many resumable streams, %s cannot be resumed\n", id)
+				}
+			}
+		}
+		recorder.record(data)
+		s.append(data)
+	}
+
+	// A stream stopped for lack of clients is incomplete and must not be cached
+	if ctx.Err() == nil {
+		recorder.save()
+	}
+	s.finish()
+
+	if id != "" {
+		time.AfterFunc(streamResumeTTL, func() { streamSessions.remove(id) })
+	}
+}
+
+func (s *streamSession) append(data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, data)
+	if len(s.events) > streamResumeBuffer {
+		s.events = s.events[1:]
+		s.first++
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *streamSession) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.done = true
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// since returns the events after sequence number after with the sequence number of the first one.
+// ok is false when some of those events were already dropped from the buffer.
+func (s *streamSession) since(after int) (events []string, seq int, done bool, changed <-chan struct{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if after+1 < s.first {
+		return nil, 0, s.done, s.changed, false
+	}
+	start := after + 1 - s.first
+	if start > len(s.events) {
+		start = len(s.events)
+	}
+	return s.events[start:], after + 1, s.done, s.changed, true
+}
+
+func (s *streamSession) attach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.followers++
+}
+
+// detach stops generation once no client has followed the stream for the grace period
+func (s *streamSession) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.followers--
+	if s.followers > 0 || s.done {
+		return
+	}
+	time.AfterFunc(streamResumeGrace, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.followers == 0 && !s.done {
+			s.cancel()
+		}
+	})
+}
+
+// follow writes the events after sequence number after to the client, then the live events until the stream ends
+func (s *streamSession) follow(c *gin.Context, after int) {
+	s.attach()
+	defer s.detach()
+
+	var (
+		ticker    *time.Ticker
+		keepalive <-chan time.Time
+	)
+	if sseKeepaliveInterval > 0 {
+		ticker = time.NewTicker(sseKeepaliveInterval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	setEventStreamHeaders(c)
+	c.Stream(func(w io.Writer) bool {
+		events, seq, done, changed, ok := s.since(after)
+		if !ok {
+			data, _ := json.Marshal(adapter.ErrorResponse{Error: &openai.APIError{
+				Code:    http.StatusGone,
+				Message: "the requested events are no longer buffered",
+				Type:    "invalid_request_error",
+			}})
+			c.Render(-1, adapter.Event{Data: string(data)})
+			c.Render(-1, adapter.Event{Data: "[DONE]"})
+			return false
+		}
+
+		if len(events) > 0 {
+			if ticker != nil {
+				ticker.Reset(sseKeepaliveInterval)
+			}
+			for i, data := range events {
+				c.Render(-1, adapter.Event{ID: strconv.Itoa(seq + i), Data: data})
+			}
+			after = seq + len(events) - 1
+			return true
+		}
+		if done {
+			c.Render(-1, adapter.Event{Data: "[DONE]"})
+			return false
+		}
+
+		select {
+		case <-changed:
+		case <-keepalive:
+			c.Render(-1, adapter.Event{Comment: "keepalive"})
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
+
+// ResumeStreamHandler replays a resumable stream after the Last-Event-ID header or last_event_id
+// query parameter, then follows it live while it is still generating
+func ResumeStreamHandler(c *gin.Context) {
+	var openaiAPIKey string
+	_, err := fmt.Sscanf(c.GetHeader("Authorization"), "Bearer %s", &openaiAPIKey)
+	if err != nil {
+		handleGenerateContentError(c, err)
+		return
+	}
+
+	// Streams of other API keys are reported as missing
+	session := streamSessions.get(c.Param("id"))
+	if session == nil || session.tenant != util.HashKey(openaiAPIKey) {
+		c.JSON(http.StatusNotFound, openai.APIError{
+			Code:    http.StatusNotFound,
+			Message: "stream not found or no longer resumable",
+			Type:    "invalid_request_error",
+		})
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	after := 0
+	if lastEventID != "" {
+		if after, err = strconv.Atoi(lastEventID); err != nil || after < 0 {
+			c.JSON(http.StatusBadRequest, openai.APIError{
+				Code:    http.StatusBadRequest,
+				Message: "invalid Last-Event-ID " + lastEventID,
+				Type:    "invalid_request_error",
+			})
+			return
+		}
+	}
+
+	session.follow(c, after)
+}
@@ -24,7 +24,27 @@ func Register(router *gin.Engine) {
 
 	// openai chat
 	router.POST("/v1/chat/completions", ChatProxyHandler)
+	router.GET("/v1/chat/completions/:id/stream", ResumeStreamHandler)
 
 	// openai embeddings
 	router.POST("/v1/embeddings", EmbeddingProxyHandler)
+
+	// probes, they need no client auth
+	router.GET("/healthz", HealthzHandler)
+	router.GET("/readyz", ReadyzHandler)
+
+	// runtime management, only available when ADMIN_TOKEN is set
+	if adminToken != "" {
+		admin := router.Group("/admin", AdminAuth)
+		admin.GET("/config", AdminConfigHandler)
+		admin.GET("/keys", AdminKeysHandler)
+		admin.GET("/streams", AdminStreamsHandler)
+		admin.GET("/circuit-breakers", CircuitBreakerStatusHandler)
+		admin.POST("/cache/flush", AdminFlushCacheHandler)
+		admin.POST("/models/refresh", AdminRefreshModelsHandler)
+		admin.POST("/models/:model/disable", AdminDisableModelHandler)
+		admin.POST("/models/:model/enable", AdminEnableModelHandler)
+		admin.POST("/keys/:key/disable", AdminDisableKeyHandler)
+		admin.POST("/keys/:key/enable", AdminEnableKeyHandler)
+	}
 }
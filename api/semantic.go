@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/generative-ai-go/genai"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/adapter"
+	"github.com/zhu327/gemini-openai-proxy/pkg/cache"
+)
+
+const (
+	semanticCacheHeader      = "X-Semantic-Cache"
+	semanticCacheScoreHeader = "X-Semantic-Cache-Score"
+)
+
+var (
+	semanticConfig = cache.SemanticConfigFromEnv()
+	semanticIndex  = cache.NewSemanticIndex(semanticConfig)
+)
+
+// semanticMatch holds the embedding of a request so its answer can be indexed after generation
+type semanticMatch struct {
+	scope  string
+	vector []float32
+}
+
+// lookupSemanticCache embeds the last user turn and searches the index for a similar prior request.
+// It returns the cached payload on a hit, or a semanticMatch to store the answer under on a miss.
+func lookupSemanticCache(
+	ctx context.Context,
+	c *gin.Context,
+	client *genai.Client,
+	apiKey, model string,
+	req *adapter.ChatCompletionRequest,
+) ([]byte, *semanticMatch) {
+	if !semanticConfig.Enabled || cacheBypassed(c) {
+		return nil, nil
+	}
+
+	text := req.LastUserText()
+	if text == "" {
+		return nil, nil
+	}
+
+	embedder := adapter.NewGeminiAdapter(client, tenantID(apiKey), semanticConfig.EmbeddingModel)
+	resp, err := embedder.GenerateEmbedding(ctx, []*genai.Content{{Parts: []genai.Part{genai.Text(text)}}}, adapter.EmbeddingOptions{SkipUsage: true})
+	if err != nil {
+		log.Printf("semantic cache embedding error %v\n", err)
+		return nil, nil
+	}
+	if len(resp.Data) == 0 {
+		log.Printf("semantic cache: empty embedding\n")
+		return nil, nil
+	}
+
+	kind := "chat"
+	if req.Stream {
+		kind = "chat-stream"
+	}
+	match := &semanticMatch{
+		scope:  semanticConfig.ScopeKey(kind, model, tenantID(apiKey), req.ContextKey()),
+		vector: resp.Data[0].Embedding,
+	}
+
+	data, score, ok := semanticIndex.Search(match.scope, match.vector)
+	if !ok {
+		c.Header(semanticCacheHeader, cacheStatusMiss)
+		return nil, match
+	}
+
+	c.Header(semanticCacheHeader, cacheStatusHit)
+	c.Header(semanticCacheScoreHeader, fmt.Sprintf("%.4f", score))
+	return data, nil
+}
+
+func (m *semanticMatch) store(v any) {
+	if m == nil {
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	semanticIndex.Add(m.scope, m.vector, data)
+}
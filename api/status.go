@@ -0,0 +1,19 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/adapter"
+)
+
+// CircuitBreakerStatusHandler reports the state of every upstream key and model circuit.
+// Keys are identified by a hash, the API keys themselves are never exposed.
+func CircuitBreakerStatusHandler(c *gin.Context) {
+	registry := adapter.Breakers()
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":  registry.Enabled(),
+		"breakers": registry.Statuses(),
+	})
+}
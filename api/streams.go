@@ -0,0 +1,42 @@
+package api
+
+import "sync"
+
+// liveStreams counts the streams currently relayed to clients, per Gemini model
+var liveStreams = &streamCounter{counts: map[string]int{}}
+
+type streamCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// start registers a stream and returns the function that unregisters it
+func (s *streamCounter) start(model string) func() {
+	s.mu.Lock()
+	s.counts[model]++
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.counts[model]--; s.counts[model] <= 0 {
+				delete(s.counts, model)
+			}
+		})
+	}
+}
+
+func (s *streamCounter) snapshot() (int, map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	counts := make(map[string]int, len(s.counts))
+	for model, n := range s.counts {
+		counts[model] = n
+		total += n
+	}
+	return total, counts
+}
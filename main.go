@@ -7,6 +7,7 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/zhu327/gemini-openai-proxy/api"
+	"github.com/zhu327/gemini-openai-proxy/pkg/server"
 )
 
 func main() {
@@ -14,12 +15,15 @@ func main() {
 	port := flag.Int("port", 8080, "Port to listen on")
 	flag.Parse()
 
+	cfg := server.ConfigFromEnv(fmt.Sprintf(":%d", *port))
+
 	// Create a new Gin router
 	router := gin.Default()
+	router.Use(server.WriteDeadline(cfg.WriteTimeout))
 	api.Register(router)
 
-	// Run the server on port 8080
-	err := router.Run(fmt.Sprintf(":%d", *port))
+	// Run the server until SIGINT or SIGTERM
+	err := server.Run(router, cfg)
 	if err != nil {
 		panic(err)
 	}
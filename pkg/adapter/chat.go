@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/generative-ai-go/genai"
@@ -25,13 +27,24 @@ const (
 
 type GeminiAdapter struct {
 	client *genai.Client
+	keyID  string
 	model  string
+
+	budget *retryBudget
+
+	// mu guards the fields below, emulated n > 1 requests update them from several goroutines
+	mu        sync.Mutex
+	modelUsed string
+	retries   int
 }
 
-func NewGeminiAdapter(client *genai.Client, model string) *GeminiAdapter {
+// NewGeminiAdapter creates an adapter for one request, keyID identifies the upstream key for circuit breaking
+func NewGeminiAdapter(client *genai.Client, keyID, model string) *GeminiAdapter {
 	return &GeminiAdapter{
 		client: client,
+		keyID:  keyID,
 		model:  model,
+		budget: newRetryBudget(GetRetryPolicy(model)),
 	}
 }
 
@@ -40,351 +53,404 @@ func (g *GeminiAdapter) GenerateContent(
 	req *ChatCompletionRequest,
 	messages []*genai.Content,
 ) (*openai.ChatCompletionResponse, error) {
-	// Add 'models/' prefix if not already present
-	modelName := g.model
-	if !strings.HasPrefix(modelName, "models/") {
-		modelName = "models/" + modelName
+	messages, err := g.resolveFileTypes(ctx, messages)
+	if err != nil {
+		return nil, err
 	}
-	model := g.client.GenerativeModel(modelName)
-	setGenaiModelByOpenaiRequest(model, req)
+	messages, deleteUploads, err := g.uploadLargeMedia(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
+	defer deleteUploads()
 
-	cs := model.StartChat()
-	setGenaiChatHistory(cs, messages)
+	// The deadline covers every attempt, fallback and regeneration of the request
+	ctx, cancel := g.budget.withDeadline(ctx)
+	defer cancel()
 
-	genaiResp, err := cs.SendMessage(ctx, messages[len(messages)-1].Parts...)
-	if err != nil {
-		var apiErr *googleapi.Error
-		if errors.As(err, &apiErr) {
-			if apiErr.Code == http.StatusTooManyRequests {
-				return nil, errors.Wrap(&openai.APIError{
-					Code:    http.StatusTooManyRequests,
-					Message: err.Error(),
-				}, "genai send message error")
+	schema := req.strictSchema()
+	for attempt := 0; ; attempt++ {
+		genaiResp, err := g.generateChoices(ctx, req, messages)
+		if err != nil {
+			if isUnavailableError(err) {
+				return nil, unavailableError(err)
 			}
-		} else {
-			log.Printf("Error is not of type *googleapi.Error: %v\n", err)
+
+			var apiErr *googleapi.Error
+			if errors.As(err, &apiErr) {
+				if apiErr.Code == http.StatusTooManyRequests {
+					return nil, errors.Wrap(&openai.APIError{
+						Code:    http.StatusTooManyRequests,
+						Message: err.Error(),
+					}, "genai send message error")
+				}
+			} else {
+				log.Printf("Error is not of type *googleapi.Error: %v\n", err)
+			}
+			return nil, errors.Wrap(err, "genai send message error")
+		}
+
+		openaiResp := genaiResponseToOpenaiResponse(g.ModelUsed(), genaiResp)
+		if schema == nil {
+			return &openaiResp, nil
+		}
+
+		// Strict structured output is regenerated until it matches the schema or the retries run out
+		err = validateChoices(&openaiResp, schema)
+		if err == nil {
+			return &openaiResp, nil
 		}
-		return nil, errors.Wrap(err, "genai send message error")
+		if attempt >= structuredOutputRetries {
+			return nil, schemaMismatchError(err)
+		}
+		log.Printf("structured output does not match schema, regenerating: %v\n", err)
 	}
-	openaiResp := genaiResponseToOpenaiResponse(g.model, genaiResp)
-	return &openaiResp, nil
 }
 
-func (g *GeminiAdapter) GenerateStreamContent(
+// generateChoices generates n choices, natively when possible and with parallel requests otherwise
+func (g *GeminiAdapter) generateChoices(
 	ctx context.Context,
 	req *ChatCompletionRequest,
 	messages []*genai.Content,
-) (<-chan string, error) {
-	modelName := g.model
-	if !strings.HasPrefix(modelName, "models/") {
-		modelName = "models/" + modelName
+) (*genai.GenerateContentResponse, error) {
+	n := req.candidateCount()
+	if n <= 1 {
+		return g.generate(ctx, req, messages, 1)
+	}
+	if !supportsNativeCandidates(messages) {
+		return g.generateParallel(ctx, req, messages, n)
 	}
-	model := g.client.GenerativeModel(modelName)
-	setGenaiModelByOpenaiRequest(model, req)
-
-	cs := model.StartChat()
-	setGenaiChatHistory(cs, messages)
-
-	iter := cs.SendMessageStream(ctx, messages[len(messages)-1].Parts...)
-
-	dataChan := make(chan string)
-	go handleStreamIter(g.model, iter, dataChan, req.StreamOptions.IncludeUsage)
 
-	return dataChan, nil
+	genaiResp, err := g.generate(ctx, req, messages, n)
+	if isCandidateCountRejected(err) {
+		log.Printf("model %s rejected candidate count %d, emulating with parallel requests\n", g.model, n)
+		return g.generateParallel(ctx, req, messages, n)
+	}
+	return genaiResp, err
 }
 
-func handleStreamIter(model string, iter *genai.GenerateContentResponseIterator, dataChan chan string, sendUsage bool) {
-	defer close(dataChan)
-
-	respID := util.GetUUID()
-	created := time.Now().Unix()
-
-	// For character-by-character streaming
-	var textBuffer string
-
-	// Counter for character-by-character streaming - increased for better performance
-	sentenceLength := 1000
-	charCount := 0
-
-	// Function to send a single character with proper formatting
-	sendCharacter := func(char string) {
-		openaiResp := &CompletionResponse{
-			ID:      fmt.Sprintf("chatcmpl-%s", respID),
-			Object:  "chat.completion.chunk",
-			Created: created,
-			Model:   GetMappedModel(model),
-			Choices: []CompletionChoice{
-				{
-					Index: 0,
-					Delta: struct {
-						Content   string            `json:"content,omitempty"`
-						Role      string            `json:"role,omitempty"`
-						ToolCalls []openai.ToolCall `json:"tool_calls,omitempty"`
-					}{
-						Content: char,
-					},
-				},
-			},
+// generate sends the request to the model and its fallbacks until one answers
+func (g *GeminiAdapter) generate(
+	ctx context.Context,
+	req *ChatCompletionRequest,
+	messages []*genai.Content,
+	candidates int32,
+) (*genai.GenerateContentResponse, error) {
+	var (
+		genaiResp *genai.GenerateContentResponse
+		err       error
+	)
+	for _, modelName := range GetModelChain(g.model) {
+		genaiResp, err = g.sendMessage(ctx, modelName, req, messages, candidates)
+		if err == nil {
+			g.setModelUsed(modelName)
+			return genaiResp, nil
 		}
-		resp, _ := json.Marshal(openaiResp)
-		dataChan <- string(resp)
+		if !shouldFallback(err) {
+			break
+		}
+		log.Printf("model %s failed, trying next fallback: %v\n", modelName, err)
 	}
+	return nil, err
+}
 
-	// Function to send entire text at once (for finish conditions)
-	sendFullText := func(text string) {
-		if text == "" {
-			return
-		}
-		openaiResp := &CompletionResponse{
-			ID:      fmt.Sprintf("chatcmpl-%s", respID),
-			Object:  "chat.completion.chunk",
-			Created: created,
-			Model:   GetMappedModel(model),
-			Choices: []CompletionChoice{
-				{
-					Index: 0,
-					Delta: struct {
-						Content   string            `json:"content,omitempty"`
-						Role      string            `json:"role,omitempty"`
-						ToolCalls []openai.ToolCall `json:"tool_calls,omitempty"`
-					}{
-						Content: text,
-					},
-				},
-			},
-		}
-		resp, _ := json.Marshal(openaiResp)
-		dataChan <- string(resp)
+// generateParallel emulates n candidates with n concurrent single candidate requests
+func (g *GeminiAdapter) generateParallel(
+	ctx context.Context,
+	req *ChatCompletionRequest,
+	messages []*genai.Content,
+	n int32,
+) (*genai.GenerateContentResponse, error) {
+	responses := make([]*genai.GenerateContentResponse, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i], errs[i] = g.generate(ctx, req, messages, 1)
+		}(i)
 	}
+	wg.Wait()
 
-	sendUsageMetadata := func(usage *genai.UsageMetadata) {
-		if usage == nil || !sendUsage {
-			return
+	merged := &genai.GenerateContentResponse{}
+	for i, resp := range responses {
+		if errs[i] != nil {
+			return nil, errs[i]
 		}
-		openaiResp := &CompletionResponse{
-			ID:      fmt.Sprintf("chatcmpl-%s", respID),
-			Object:  "chat.completion.chunk",
-			Created: created,
-			Model:   GetMappedModel(model),
-			Choices: []CompletionChoice{},
-			Usage: openai.Usage{
-				PromptTokens:     int(usage.PromptTokenCount),
-				CompletionTokens: int(usage.CandidatesTokenCount),
-				TotalTokens:      int(usage.TotalTokenCount),
-			},
+		for _, candidate := range resp.Candidates {
+			candidate.Index = int32(i)
+			merged.Candidates = append(merged.Candidates, candidate)
 		}
-		resp, _ := json.Marshal(openaiResp)
-		dataChan <- string(resp)
+		merged.UsageMetadata = addUsageMetadata(merged.UsageMetadata, resp.UsageMetadata)
 	}
+	return merged, nil
+}
 
-	var usageMetadata *genai.UsageMetadata
+func (g *GeminiAdapter) sendMessage(
+	ctx context.Context,
+	modelName string,
+	req *ChatCompletionRequest,
+	messages []*genai.Content,
+	candidates int32,
+) (*genai.GenerateContentResponse, error) {
+	model := g.client.GenerativeModel(withModelsPrefix(modelName))
+	setGenaiModelByOpenaiRequest(model, req)
 
-	for {
-		genaiResp, err := iter.Next()
-		if err == iterator.Done {
-			// Send any remaining text when done - all at once
-			if len(textBuffer) > 0 {
-				// Send all remaining text at once when done
-				sendFullText(textBuffer)
+	var genaiResp *genai.GenerateContentResponse
+	retries, err := GetRetryPolicy(modelName).Do(ctx, g.budget, func(ctx context.Context) error {
+		return g.guard(modelName, func() error {
+			var err error
+			if candidates > 1 {
+				// Chat sessions always ask for one candidate, a single turn request can ask for more
+				model.SetCandidateCount(candidates)
+				genaiResp, err = model.GenerateContent(ctx, messages[len(messages)-1].Parts...)
+				return err
 			}
-			// per https://community.openai.com/t/usage-stats-now-available-when-using-streaming-with-the-chat-completions-api-or-completions-api/738156
-			// the usage is sent after everything else
-			sendUsageMetadata(usageMetadata)
-			break
-		}
 
-		if err != nil {
-			log.Printf("genai get stream message error %v\n", err)
-
-			// Check for context cancellation
-			if errors.Is(err, context.Canceled) {
-				log.Printf("Context was canceled by client")
-				apiErr := openai.APIError{
-					Code:    http.StatusRequestTimeout,
-					Message: "Request was canceled",
-					Type:    "canceled_error",
-				}
-				resp, _ := json.Marshal(apiErr)
-				dataChan <- string(resp)
-				break
-			}
+			// A chat session appends to its history on every send, so each attempt needs a fresh one
+			cs := model.StartChat()
+			setGenaiChatHistory(cs, messages)
+			genaiResp, err = cs.SendMessage(ctx, messages[len(messages)-1].Parts...)
+			return err
+		})
+	})
+	g.addRetries(retries)
+	return genaiResp, err
+}
 
-			// Check for rate limit errors
-			var apiErr *googleapi.Error
-			if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests {
-				log.Printf("Rate limit exceeded: %v\n", err)
-				rateLimitErr := openai.APIError{
-					Code:    http.StatusTooManyRequests,
-					Message: "Rate limit exceeded",
-					Type:    "rate_limit_error",
-				}
-				resp, _ := json.Marshal(rateLimitErr)
-				dataChan <- string(resp)
-				break
-			}
+func (g *GeminiAdapter) GenerateStreamContent(
+	ctx context.Context,
+	req *ChatCompletionRequest,
+	messages []*genai.Content,
+) (<-chan string, error) {
+	messages, err := g.resolveFileTypes(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
+	messages, deleteUploads, err := g.uploadLargeMedia(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
 
-			// Handle other errors
-			generalErr := openai.APIError{
-				Code:    http.StatusInternalServerError,
-				Message: err.Error(),
-				Type:    "internal_server_error",
-			}
-			resp, _ := json.Marshal(generalErr)
-			dataChan <- string(resp)
-			break
-		}
-		// gemini returns the usage data on each response, adding to it each time, so always get the latest
-		usageMetadata = genaiResp.UsageMetadata
+	n := req.candidateCount()
 
-		// Process each candidate's text content
-		for _, candidate := range genaiResp.Candidates {
-			if candidate.Content == nil {
-				continue
-			}
+	// Cancelling the stream context stops every upstream read, it is cancelled when the relay ends,
+	// when one of several parallel streams fails, or when the caller's context is done
+	ctx, cancel := context.WithCancel(ctx)
 
-			// Check if this is the last message with a finish reason
-			isLastMessage := candidate.FinishReason > genai.FinishReasonStop
+	// The request deadline only bounds the start of the streams, not their relay
+	if !g.budget.deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(g.budget.deadline), cancel)
+		defer timer.Stop()
+	}
 
-			for _, part := range candidate.Content.Parts {
-				switch pp := part.(type) {
-				case genai.Text:
-					text := string(pp)
-					if isLastMessage {
-						// If this is the last message, collect the text in buffer
-						textBuffer += text
-					} else if charCount < sentenceLength {
-						// Stream character by character until we reach sentenceLength
-						for i, char := range text {
-							if charCount < sentenceLength {
-								sendCharacter(string(char))
-								// No delay between characters for faster streaming
-								charCount++
-							} else {
-								// Once we've reached sentenceLength, send the rest of this text at once
-								remaining := text[i:]
-								if remaining != "" {
-									sendFullText(remaining)
-								}
-								break
-							}
-						}
-					} else {
-						// For subsequent chunks after sentenceLength, send the entire text at once
-						sendFullText(text)
-					}
-				case genai.FunctionCall:
-					// Handle function calls as before
-					openaiResp := genaiResponseToStreamCompletionResponse(model, genaiResp, respID, created)
-					resp, _ := json.Marshal(openaiResp)
-					dataChan <- string(resp)
-				}
-			}
+	var streams []*upstreamStream
+	if n > 1 && supportsNativeCandidates(messages) {
+		var stream *upstreamStream
+		stream, err = g.startStream(ctx, req, messages, n)
+		if isCandidateCountRejected(err) {
+			log.Printf("model %s rejected candidate count %d, emulating with parallel streams\n", g.model, n)
+			streams, err = g.startParallelStreams(ctx, req, messages, n)
+		} else if err == nil {
+			streams = []*upstreamStream{stream}
 		}
+	} else if n > 1 {
+		streams, err = g.startParallelStreams(ctx, req, messages, n)
+	} else {
+		var stream *upstreamStream
+		stream, err = g.startStream(ctx, req, messages, 1)
+		streams = []*upstreamStream{stream}
+	}
 
-		// Send finish reason if present
-		if len(genaiResp.Candidates) > 0 && genaiResp.Candidates[0].FinishReason > genai.FinishReasonStop {
-			// Send any accumulated text all at once
-			if len(textBuffer) > 0 {
-				sendFullText(textBuffer)
-			}
+	if err != nil {
+		cancel()
+		deleteUploads()
+		if isUnavailableError(err) {
+			return nil, unavailableError(err)
+		}
+		return nil, errors.Wrap(err, "genai send message stream error")
+	}
 
-			// Send the finish reason
-			for _, candidate := range genaiResp.Candidates {
-				if candidate.FinishReason > genai.FinishReasonStop {
-					openaiFinishReason := string(convertFinishReason(candidate.FinishReason))
-					openaiResp := &CompletionResponse{
-						ID:      fmt.Sprintf("chatcmpl-%s", respID),
-						Object:  "chat.completion.chunk",
-						Created: created,
-						Model:   GetMappedModel(model),
-						Choices: []CompletionChoice{
-							{
-								Index: 0,
-								Delta: struct {
-									Content   string            `json:"content,omitempty"`
-									Role      string            `json:"role,omitempty"`
-									ToolCalls []openai.ToolCall `json:"tool_calls,omitempty"`
-								}{
-									// Empty content for finish reason message
-								},
-								FinishReason: &openaiFinishReason,
-							},
-						},
-					}
-					resp, _ := json.Marshal(openaiResp)
-					dataChan <- string(resp)
-					break
-				}
-			}
+	// The uploads are deleted when the relay stops, before dataChan is closed and the caller
+	// may close the client
+	stop := func() {
+		cancel()
+		deleteUploads()
+	}
+	dataChan := make(chan string, streamBufferSize)
+	go relayStreams(ctx, stop, g.ModelUsed(), streams, dataChan, req.StreamOptions.IncludeUsage, req.strictSchema())
+
+	return dataChan, nil
+}
+
+// contentIterator yields the responses of a Gemini stream until iterator.Done
+type contentIterator interface {
+	Next() (*genai.GenerateContentResponse, error)
+}
+
+// upstreamStream is a started Gemini stream whose first chunk has already been received
+type upstreamStream struct {
+	iter  contentIterator
+	first *genai.GenerateContentResponse
+}
+
+// startStream starts a stream on the model and its fallbacks until one answers
+func (g *GeminiAdapter) startStream(
+	ctx context.Context,
+	req *ChatCompletionRequest,
+	messages []*genai.Content,
+	candidates int32,
+) (*upstreamStream, error) {
+	var err error
+	for _, modelName := range GetModelChain(g.model) {
+		var stream *upstreamStream
+		stream, err = g.sendMessageStream(ctx, modelName, req, messages, candidates)
+		if err == nil {
+			g.setModelUsed(modelName)
+			return stream, nil
+		}
+		if !shouldFallback(err) {
 			break
 		}
+		log.Printf("model %s failed, trying next fallback: %v\n", modelName, err)
 	}
+	return nil, err
 }
 
-func genaiResponseToStreamCompletionResponse(
-	model string,
-	genaiResp *genai.GenerateContentResponse,
-	respID string,
-	created int64,
-) *CompletionResponse {
-	resp := CompletionResponse{
-		ID:      fmt.Sprintf("chatcmpl-%s", respID),
-		Object:  "chat.completion.chunk",
-		Created: created,
-		Model:   GetMappedModel(model),
-		Choices: make([]CompletionChoice, 0, len(genaiResp.Candidates)),
+// startParallelStreams emulates n candidates with n concurrent single candidate streams
+func (g *GeminiAdapter) startParallelStreams(
+	ctx context.Context,
+	req *ChatCompletionRequest,
+	messages []*genai.Content,
+	n int32,
+) ([]*upstreamStream, error) {
+	streams := make([]*upstreamStream, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := range streams {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			streams[i], errs[i] = g.startStream(ctx, req, messages, 1)
+		}(i)
 	}
+	wg.Wait()
 
-	count := 0
-	toolCalls := make([]openai.ToolCall, 0)
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return streams, nil
+}
 
-	for _, candidate := range genaiResp.Candidates {
-		parts := candidate.Content.Parts
-		for _, part := range parts {
-			index := count
-			switch pp := part.(type) {
-			case genai.Text:
-				choice := CompletionChoice{
-					Index: index,
-				}
-				choice.Delta.Content = string(pp)
+// sendMessageStream starts a stream and waits for its first chunk,
+// so failures before anything is sent to the client can still be retried or fall back
+func (g *GeminiAdapter) sendMessageStream(
+	ctx context.Context,
+	modelName string,
+	req *ChatCompletionRequest,
+	messages []*genai.Content,
+	candidates int32,
+) (*upstreamStream, error) {
+	model := g.client.GenerativeModel(withModelsPrefix(modelName))
+	setGenaiModelByOpenaiRequest(model, req)
 
-				if candidate.FinishReason > genai.FinishReasonStop {
-					log.Printf("genai message finish reason %s\n", candidate.FinishReason.String())
-					openaiFinishReason := string(convertFinishReason(candidate.FinishReason))
-					choice.FinishReason = &openaiFinishReason
-				}
+	stream := &upstreamStream{}
+	retries, err := GetRetryPolicy(modelName).Do(ctx, g.budget, func(ctx context.Context) error {
+		return g.guard(modelName, func() error {
+			if candidates > 1 {
+				model.SetCandidateCount(candidates)
+				stream.iter = model.GenerateContentStream(ctx, messages[len(messages)-1].Parts...)
+			} else {
+				cs := model.StartChat()
+				setGenaiChatHistory(cs, messages)
+				stream.iter = cs.SendMessageStream(ctx, messages[len(messages)-1].Parts...)
+			}
 
-				resp.Choices = append(resp.Choices, choice)
-			case genai.FunctionCall:
-				args, _ := json.Marshal(pp.Args)
-				toolCalls = append(toolCalls, openai.ToolCall{
-					Index:    genai.Ptr(int(index)),
-					ID:       fmt.Sprintf("%s-%d", pp.Name, index),
-					Type:     openai.ToolTypeFunction,
-					Function: openai.FunctionCall{Name: pp.Name, Arguments: string(args)},
-				})
+			var err error
+			stream.first, err = stream.iter.Next()
+			if err == iterator.Done {
+				return nil
 			}
-			count++
-		}
+			return err
+		})
+	})
+	g.addRetries(retries)
+	if err != nil {
+		return nil, err
 	}
+	return stream, nil
+}
 
-	if len(toolCalls) > 0 {
-		choice := CompletionChoice{
-			Index: 0,
-		}
-		// For tool calls, we need to set a special finish reason
-		openaiFinishReason := string(openai.FinishReasonToolCalls)
-		choice.FinishReason = &openaiFinishReason
+// Retries returns the number of upstream retries made by this adapter
+func (g *GeminiAdapter) Retries() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.retries
+}
 
-		// Add the tool calls to the response
-		toolCallsJSON, _ := json.Marshal(toolCalls)
-		choice.Delta.Content = string(toolCallsJSON)
+// ModelUsed returns the Gemini model that produced the response, which differs from
+// the requested model when a fallback answered
+func (g *GeminiAdapter) ModelUsed() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.modelUsed == "" {
+		return g.model
+	}
+	return g.modelUsed
+}
 
-		resp.Choices = append(resp.Choices, choice)
+func (g *GeminiAdapter) addRetries(retries int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.retries += retries
+}
+
+func (g *GeminiAdapter) setModelUsed(model string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.modelUsed = model
+}
+
+// withModelsPrefix adds the 'models/' prefix if not already present
+func withModelsPrefix(modelName string) string {
+	if !strings.HasPrefix(modelName, "models/") {
+		return "models/" + modelName
 	}
+	return modelName
+}
+
+// supportsNativeCandidates reports whether the request can use CandidateCount. The SDK chat session
+// always asks for a single candidate, so only single turn requests can ask for several natively.
+func supportsNativeCandidates(messages []*genai.Content) bool {
+	return len(messages) == 1
+}
 
-	return &resp
+// isCandidateCountRejected reports whether the model refused to generate multiple candidates
+func isCandidateCountRejected(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) &&
+		apiErr.Code == http.StatusBadRequest &&
+		strings.Contains(strings.ToLower(apiErr.Message), "candidate")
+}
+
+// addUsageMetadata sums token counts, emulated candidates are billed as separate requests
+func addUsageMetadata(a, b *genai.UsageMetadata) *genai.UsageMetadata {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return &genai.UsageMetadata{
+		PromptTokenCount:        a.PromptTokenCount + b.PromptTokenCount,
+		CachedContentTokenCount: a.CachedContentTokenCount + b.CachedContentTokenCount,
+		CandidatesTokenCount:    a.CandidatesTokenCount + b.CandidatesTokenCount,
+		TotalTokenCount:         a.TotalTokenCount + b.TotalTokenCount,
+	}
 }
 
 func genaiResponseToOpenaiResponse(
@@ -397,6 +463,8 @@ func genaiResponseToOpenaiResponse(
 		Created: time.Now().Unix(),
 		Model:   GetMappedModel(model),
 		Choices: make([]openai.ChatCompletionChoice, 0, len(genaiResp.Candidates)),
+
+		SystemFingerprint: systemFingerprint(model),
 	}
 
 	if genaiResp.UsageMetadata != nil {
@@ -407,29 +475,23 @@ func genaiResponseToOpenaiResponse(
 		}
 	}
 
-	for i, candidate := range genaiResp.Candidates {
+	for _, candidate := range genaiResp.Candidates {
 		toolCalls := make([]openai.ToolCall, 0)
-		var content string
+		var content strings.Builder
 
 		if candidate.Content != nil && len(candidate.Content.Parts) > 0 {
 			for j, part := range candidate.Content.Parts {
 				switch pp := part.(type) {
 				case genai.Text:
-					content = string(pp)
+					content.WriteString(string(pp))
 				case genai.FunctionCall:
-					args, _ := json.Marshal(pp.Args)
-					toolCalls = append(toolCalls, openai.ToolCall{
-						Index:    genai.Ptr(j),
-						ID:       fmt.Sprintf("%s-%d", pp.Name, j),
-						Type:     openai.ToolTypeFunction,
-						Function: openai.FunctionCall{Name: pp.Name, Arguments: string(args)},
-					})
+					toolCalls = append(toolCalls, genaiFunctionCallToOpenaiToolCall(pp, j))
 				}
 			}
 		}
 
 		choice := openai.ChatCompletionChoice{
-			Index:        i,
+			Index:        int(candidate.Index),
 			FinishReason: convertFinishReason(candidate.FinishReason),
 		}
 
@@ -442,15 +504,26 @@ func genaiResponseToOpenaiResponse(
 		} else {
 			choice.Message = openai.ChatCompletionMessage{
 				Role:    openai.ChatMessageRoleAssistant,
-				Content: content,
+				Content: content.String(),
 			}
 		}
 
 		resp.Choices = append(resp.Choices, choice)
 	}
+	sort.Slice(resp.Choices, func(i, j int) bool { return resp.Choices[i].Index < resp.Choices[j].Index })
 	return resp
 }
 
+func genaiFunctionCallToOpenaiToolCall(call genai.FunctionCall, index int) openai.ToolCall {
+	args, _ := json.Marshal(call.Args)
+	return openai.ToolCall{
+		Index:    genai.Ptr(index),
+		ID:       newToolCallID(call.Name),
+		Type:     openai.ToolTypeFunction,
+		Function: openai.FunctionCall{Name: call.Name, Arguments: string(args)},
+	}
+}
+
 func convertFinishReason(reason genai.FinishReason) openai.FinishReason {
 	openaiFinishReason := openai.FinishReasonStop
 	switch reason {
@@ -479,6 +552,9 @@ func setGenaiChatHistory(cs *genai.ChatSession, messages []*genai.Content) {
 }
 
 func setGenaiModelByOpenaiRequest(model *genai.GenerativeModel, req *ChatCompletionRequest) {
+	// The messages were validated by ToGenaiMessages, so the instruction cannot fail to parse here
+	model.SystemInstruction, _ = req.toGenaiSystemInstruction()
+
 	if req.MaxTokens != 0 {
 		model.MaxOutputTokens = &req.MaxTokens
 	}
@@ -492,14 +568,12 @@ func setGenaiModelByOpenaiRequest(model *genai.GenerativeModel, req *ChatComplet
 		model.StopSequences = req.Stop
 	}
 
-	// Set response format if specified
-	if req.ResponseFormat != nil && req.ResponseFormat.Type == "json" {
-		model.ResponseMIMEType = "application/json"
-	}
+	setGenaiResponseFormat(model, req)
 
 	// Configure tools if provided
 	if len(req.Tools) > 0 {
-		tools := convertOpenAIToolsToGenAI(req.Tools)
+		// Conversion issues are rejected by ToGenaiMessages before the model is built
+		tools, _ := convertOpenAIToolsToGenAI(req.Tools)
 		model.Tools = tools
 
 		// Configure tool choice/function calling mode
@@ -546,24 +620,39 @@ func setGenaiModelByOpenaiRequest(model *genai.GenerativeModel, req *ChatComplet
 	}
 }
 
+// GenerateEmbedding embeds each message. The usage is counted by the model when it supports
+// countTokens, otherwise prompt_tokens is an estimate of four characters per token.
 func (g *GeminiAdapter) GenerateEmbedding(
 	ctx context.Context,
 	messages []*genai.Content,
+	opts EmbeddingOptions,
 ) (*openai.EmbeddingResponse, error) {
-	// Add 'models/' prefix if not already present
-	modelName := g.model
-	if !strings.HasPrefix(modelName, "models/") {
-		modelName = "models/" + modelName
-	}
-	model := g.client.EmbeddingModel(modelName)
+	model := g.client.EmbeddingModel(withModelsPrefix(g.model))
+	model.TaskType = opts.TaskType
 
 	batchEmbeddings := model.NewBatch()
 	for _, message := range messages {
-		batchEmbeddings = batchEmbeddings.AddContent(message.Parts...)
+		batchEmbeddings = batchEmbeddings.AddContentWithTitle(opts.Title, message.Parts...)
 	}
 
-	genaiResp, err := model.BatchEmbedContents(ctx, batchEmbeddings)
+	// Counting runs next to embedding, so it adds no latency
+	tokens := make(chan int, 1)
+	if opts.SkipUsage {
+		tokens <- 0
+	} else {
+		go func() { tokens <- g.countEmbeddingTokens(ctx, messages) }()
+	}
+
+	var genaiResp *genai.BatchEmbedContentsResponse
+	err := g.guard(g.model, func() error {
+		var err error
+		genaiResp, err = model.BatchEmbedContents(ctx, batchEmbeddings)
+		return err
+	})
 	if err != nil {
+		if isUnavailableError(err) {
+			return nil, unavailableError(err)
+		}
 		return nil, errors.Wrap(err, "genai generate embeddings error")
 	}
 
@@ -572,11 +661,17 @@ func (g *GeminiAdapter) GenerateEmbedding(
 		Data:   make([]openai.Embedding, 0, len(genaiResp.Embeddings)),
 		Model:  openai.EmbeddingModel(GetMappedModel(g.model)),
 	}
+	promptTokens := <-tokens
+	openaiResp.Usage = openai.Usage{PromptTokens: promptTokens, TotalTokens: promptTokens}
 
 	for i, genaiEmbedding := range genaiResp.Embeddings {
+		values, err := truncateEmbedding(genaiEmbedding.Values, opts.Dimensions)
+		if err != nil {
+			return nil, err
+		}
 		embedding := openai.Embedding{
 			Object:    "embedding",
-			Embedding: genaiEmbedding.Values,
+			Embedding: values,
 			Index:     i,
 		}
 		openaiResp.Data = append(openaiResp.Data, embedding)
@@ -0,0 +1,274 @@
+package adapter
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+const (
+	ChunkingPassthrough = "passthrough" // One event per upstream chunk
+	ChunkingChar        = "char"        // One event per character for the first sentenceLength characters
+	ChunkingTime        = "time"        // Upstream text is coalesced until the window has passed
+	ChunkingBytes       = "bytes"       // Upstream text is coalesced until the byte window is full
+	ChunkingWord        = "word"        // Events end on a word boundary
+	ChunkingSentence    = "sentence"    // Events end on a sentence boundary
+)
+
+// ChunkingConfig controls how streamed text is split into events
+type ChunkingConfig struct {
+	Strategy string
+	Window   time.Duration
+	Bytes    int
+}
+
+type chunkingConfigJSON struct {
+	Strategy string `json:"strategy"`
+	Window   string `json:"window"`
+	Bytes    *int   `json:"bytes"`
+}
+
+var (
+	defaultChunkingConfig = loadDefaultChunkingConfig()
+	modelChunkingConfigs  = loadModelChunkingConfigs(os.Getenv("STREAM_CHUNKING_MODELS"))
+)
+
+func loadDefaultChunkingConfig() ChunkingConfig {
+	cfg := ChunkingConfig{
+		Strategy: util.GetEnvString("STREAM_CHUNKING", ChunkingPassthrough),
+		Window:   util.GetEnvDuration("STREAM_CHUNKING_WINDOW", 50*time.Millisecond),
+		Bytes:    util.GetEnvInt("STREAM_CHUNKING_BYTES", 64),
+	}
+	if err := cfg.validate(); err != nil {
+		util.ReportConfigError("Invalid STREAM_CHUNKING, using passthrough", err)
+		cfg.Strategy = ChunkingPassthrough
+	}
+	return cfg
+}
+
+// loadModelChunkingConfigs parses per model overrides such as {"gemini-1.5-pro-latest":{"strategy":"sentence"}}
+func loadModelChunkingConfigs(raw string) map[string]ChunkingConfig {
+	configs := map[string]ChunkingConfig{}
+	if raw == "" {
+		return configs
+	}
+
+	overrides := map[string]chunkingConfigJSON{}
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		util.ReportConfigError("Invalid STREAM_CHUNKING_MODELS, using defaults", err)
+		return configs
+	}
+
+	for model, override := range overrides {
+		cfg := defaultChunkingConfig
+		if override.Strategy != "" {
+			cfg.Strategy = override.Strategy
+		}
+		if d, err := time.ParseDuration(override.Window); err == nil {
+			cfg.Window = d
+		}
+		if override.Bytes != nil {
+			cfg.Bytes = *override.Bytes
+		}
+		if err := cfg.validate(); err != nil {
+			util.ReportConfigError("Invalid STREAM_CHUNKING_MODELS entry for "+model+", using defaults", err)
+			continue
+		}
+		configs[model] = cfg
+	}
+	return configs
+}
+
+func (cfg ChunkingConfig) validate() error {
+	switch cfg.Strategy {
+	case ChunkingPassthrough, ChunkingChar, ChunkingTime, ChunkingBytes, ChunkingWord, ChunkingSentence:
+		return nil
+	default:
+		return errors.Errorf("unknown chunking strategy %q", cfg.Strategy)
+	}
+}
+
+// GetChunkingConfig returns the chunking configured for a Gemini model
+func GetChunkingConfig(model string) ChunkingConfig {
+	if cfg, ok := modelChunkingConfigs[model]; ok {
+		return cfg
+	}
+	return defaultChunkingConfig
+}
+
+// ChunkingConfigs returns the default chunking under "default" together with the per model overrides
+func ChunkingConfigs() map[string]ChunkingConfig {
+	configs := map[string]ChunkingConfig{"default": defaultChunkingConfig}
+	for model, cfg := range modelChunkingConfigs {
+		configs[model] = cfg
+	}
+	return configs
+}
+
+// textChunker splits the text of one choice into the contents of its events
+type textChunker interface {
+	// Write takes upstream text and returns the contents that are ready to be sent
+	Write(text string) []string
+	// Flush returns the text held back, it is called before anything else is sent for the choice
+	Flush() string
+}
+
+// timedChunker is a textChunker that holds text back for a time. The relay calls Write with no
+// text once Due has passed, so held text does not wait for the next upstream chunk.
+type timedChunker interface {
+	textChunker
+	// Due returns when the held text is to be sent, or the zero time when nothing is held
+	Due() time.Time
+}
+
+func newTextChunker(cfg ChunkingConfig) textChunker {
+	switch cfg.Strategy {
+	case ChunkingChar:
+		return &charChunker{}
+	case ChunkingTime:
+		return &timeChunker{window: cfg.Window}
+	case ChunkingBytes:
+		return &bytesChunker{size: cfg.Bytes}
+	case ChunkingWord:
+		return &boundaryChunker{boundary: lastWordBoundary}
+	case ChunkingSentence:
+		return &boundaryChunker{boundary: lastSentenceBoundary}
+	default:
+		return passthroughChunker{}
+	}
+}
+
+type passthroughChunker struct{}
+
+func (passthroughChunker) Write(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return []string{text}
+}
+
+func (passthroughChunker) Flush() string { return "" }
+
+// charChunker sends one character per event until sentenceLength characters were sent, then text as it arrives
+type charChunker struct {
+	count int
+}
+
+func (c *charChunker) Write(text string) []string {
+	var chunks []string
+	for i, char := range text {
+		if c.count >= sentenceLength {
+			// Once we've reached sentenceLength, send the rest of this text at once
+			return append(chunks, text[i:])
+		}
+		chunks = append(chunks, string(char))
+		c.count++
+	}
+	return chunks
+}
+
+func (c *charChunker) Flush() string { return "" }
+
+// timeChunker holds text back until window has passed since the last event.
+// Held text is sent when the window ends, with the next upstream chunk, or when the choice finishes.
+type timeChunker struct {
+	window time.Duration
+	last   time.Time
+	buf    strings.Builder
+}
+
+func (c *timeChunker) Write(text string) []string {
+	c.buf.WriteString(text)
+	if c.buf.Len() == 0 || time.Since(c.last) < c.window {
+		return nil
+	}
+	c.last = time.Now()
+	return []string{c.Flush()}
+}
+
+func (c *timeChunker) Due() time.Time {
+	if c.buf.Len() == 0 {
+		return time.Time{}
+	}
+	return c.last.Add(c.window)
+}
+
+func (c *timeChunker) Flush() string {
+	text := c.buf.String()
+	c.buf.Reset()
+	return text
+}
+
+// bytesChunker holds text back until at least size bytes are buffered
+type bytesChunker struct {
+	size int
+	buf  strings.Builder
+}
+
+func (c *bytesChunker) Write(text string) []string {
+	c.buf.WriteString(text)
+	if c.buf.Len() == 0 || c.buf.Len() < c.size {
+		return nil
+	}
+	return []string{c.Flush()}
+}
+
+func (c *bytesChunker) Flush() string {
+	text := c.buf.String()
+	c.buf.Reset()
+	return text
+}
+
+// boundaryChunker sends text up to the last boundary and holds back the rest
+type boundaryChunker struct {
+	// boundary returns the end of the last complete unit in text, or 0 when there is none
+	boundary func(text string) int
+	pending  string
+}
+
+func (c *boundaryChunker) Write(text string) []string {
+	c.pending += text
+	end := c.boundary(c.pending)
+	if end == 0 {
+		return nil
+	}
+	chunk := c.pending[:end]
+	c.pending = c.pending[end:]
+	return []string{chunk}
+}
+
+func (c *boundaryChunker) Flush() string {
+	text := c.pending
+	c.pending = ""
+	return text
+}
+
+// lastWordBoundary ends after the last whitespace
+func lastWordBoundary(text string) int {
+	end := strings.LastIndexAny(text, " \t\n")
+	return end + 1
+}
+
+// lastSentenceBoundary ends after the last sentence terminator that is followed by whitespace,
+// or after a terminator without spaces around it such as in CJK text
+func lastSentenceBoundary(text string) int {
+	for i := len(text); i > 0; {
+		r, size := utf8.DecodeLastRuneInString(text[:i])
+		i -= size
+		switch r {
+		case '\n', '。', '！', '？':
+			return i + size
+		case '.', '!', '?':
+			if rest := text[i+size:]; rest != "" && strings.IndexAny(rest[:1], " \t") == 0 {
+				return i + size + 1
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package adapter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/breaker"
+)
+
+// ErrCircuitOpen is returned without calling upstream while the circuit of a key and model is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+var breakers = breaker.NewRegistry(breaker.ConfigFromEnv())
+
+// Breakers returns the circuit breaker registry shared by all adapters
+func Breakers() *breaker.Registry {
+	return breakers
+}
+
+// guard runs fn through the circuit breaker of the adapter key and the given model
+func (g *GeminiAdapter) guard(modelName string, fn func() error) error {
+	if disabledModels.isDisabled(modelName) {
+		return errors.Wrapf(ErrDisabled, "model %s", modelName)
+	}
+	if disabledKeys.isDisabled(g.keyID) {
+		return errors.Wrapf(ErrDisabled, "key %s", g.keyID)
+	}
+
+	if !breakers.Enabled() {
+		return fn()
+	}
+
+	b := breakers.Get(g.keyID, modelName)
+	if !b.Allow() {
+		return errors.Wrapf(ErrCircuitOpen, "model %s", modelName)
+	}
+
+	start := time.Now()
+	err := fn()
+	if errors.Is(err, context.Canceled) {
+		b.Cancel()
+		return err
+	}
+	b.Record(isBreakerFailure(err), time.Since(start))
+	return err
+}
+
+// isBreakerFailure reports whether err indicates an unhealthy upstream rather than a bad request
+func isBreakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)
+}
+
+// isUnavailableError reports whether err means the request was refused without calling upstream
+func isUnavailableError(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrDisabled)
+}
+
+// unavailableError converts an open circuit or a disabled model or key into the OpenAI error returned to the client
+func unavailableError(err error) error {
+	return &openai.APIError{
+		Code:    http.StatusServiceUnavailable,
+		Message: err.Error(),
+		Type:    "server_error",
+	}
+}
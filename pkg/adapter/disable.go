@@ -0,0 +1,104 @@
+package adapter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrDisabled is returned without calling upstream for a model or key disabled by an administrator
+var ErrDisabled = errors.New("disabled by administrator")
+
+// disabledSet holds names disabled until a deadline, a zero deadline disables until re-enabled
+type disabledSet struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+var (
+	disabledModels = &disabledSet{until: map[string]time.Time{}}
+	disabledKeys   = &disabledSet{until: map[string]time.Time{}}
+)
+
+func (s *disabledSet) disable(name string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	s.until[name] = until
+}
+
+func (s *disabledSet) enable(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.until, name)
+}
+
+func (s *disabledSet) isDisabled(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.until[name]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && time.Now().After(until) {
+		delete(s.until, name)
+		return false
+	}
+	return true
+}
+
+func (s *disabledSet) list() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	result := make(map[string]time.Time, len(s.until))
+	for name, until := range s.until {
+		if !until.IsZero() && now.After(until) {
+			delete(s.until, name)
+			continue
+		}
+		result[name] = until
+	}
+	return result
+}
+
+// DisableModel stops requests to a Gemini model for d, or until EnableModel when d is zero
+func DisableModel(model string, d time.Duration) {
+	disabledModels.disable(model, d)
+}
+
+func EnableModel(model string) {
+	disabledModels.enable(model)
+}
+
+// DisabledModels returns the disabled models and when they are re-enabled, a zero time means never
+func DisabledModels() map[string]time.Time {
+	return disabledModels.list()
+}
+
+// DisableKey stops requests with an upstream key, identified by its hash, for d or until EnableKey when d is zero
+func DisableKey(keyID string, d time.Duration) {
+	disabledKeys.disable(keyID, d)
+}
+
+func EnableKey(keyID string) {
+	disabledKeys.enable(keyID)
+}
+
+// IsKeyDisabled reports whether an upstream key, identified by its hash, is disabled
+func IsKeyDisabled(keyID string) bool {
+	return disabledKeys.isDisabled(keyID)
+}
+
+// DisabledKeys returns the disabled key hashes and when they are re-enabled, a zero time means never
+func DisabledKeys() map[string]time.Time {
+	return disabledKeys.list()
+}
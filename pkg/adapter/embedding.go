@@ -0,0 +1,179 @@
+package adapter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+)
+
+// EmbeddingOptions are the parameters of an embeddings request besides the input
+type EmbeddingOptions struct {
+	// Dimensions truncates the embeddings, 0 keeps the size of the model
+	Dimensions int
+	TaskType   genai.TaskType
+	Title      string
+	// SkipUsage leaves the usage empty, for embeddings the proxy makes for itself
+	SkipUsage bool
+}
+
+var embeddingTaskTypes = map[string]genai.TaskType{
+	"RETRIEVAL_QUERY":     genai.TaskTypeRetrievalQuery,
+	"RETRIEVAL_DOCUMENT":  genai.TaskTypeRetrievalDocument,
+	"SEMANTIC_SIMILARITY": genai.TaskTypeSemanticSimilarity,
+	"CLASSIFICATION":      genai.TaskTypeClassification,
+	"CLUSTERING":          genai.TaskTypeClustering,
+	"QUESTION_ANSWERING":  genai.TaskTypeQuestionAnswering,
+	"FACT_VERIFICATION":   genai.TaskTypeFactVerification,
+}
+
+// Options validates the parameters of the request and converts them for GenerateEmbedding
+func (req *EmbeddingRequest) Options() (EmbeddingOptions, error) {
+	var opts EmbeddingOptions
+
+	if req.Dimensions < 0 {
+		return opts, errors.Errorf("dimensions must be positive, got %d", req.Dimensions)
+	}
+	opts.Dimensions = req.Dimensions
+
+	switch req.EncodingFormat {
+	case "", openai.EmbeddingEncodingFormatFloat, openai.EmbeddingEncodingFormatBase64:
+	default:
+		return opts, errors.Errorf("unsupported encoding_format %q, use float or base64", req.EncodingFormat)
+	}
+
+	if req.Gemini == nil {
+		return opts, nil
+	}
+	if req.Gemini.TaskType != "" {
+		taskType, ok := embeddingTaskTypes[strings.ToUpper(req.Gemini.TaskType)]
+		if !ok {
+			return opts, errors.Errorf("unsupported gemini.task_type %q", req.Gemini.TaskType)
+		}
+		opts.TaskType = taskType
+	}
+	// Gemini only uses titles for documents
+	if req.Gemini.Title != "" && opts.TaskType != genai.TaskTypeUnspecified && opts.TaskType != genai.TaskTypeRetrievalDocument {
+		return opts, errors.New("gemini.title can only be used with the RETRIEVAL_DOCUMENT task_type")
+	}
+	opts.Title = req.Gemini.Title
+	return opts, nil
+}
+
+// truncateEmbedding keeps the first dimensions values and scales them back to unit length,
+// as Gemini embeddings are trained so that their leading values carry the most meaning
+func truncateEmbedding(values []float32, dimensions int) ([]float32, error) {
+	if dimensions == 0 || dimensions == len(values) {
+		return values, nil
+	}
+	if dimensions > len(values) {
+		return nil, &openai.APIError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("dimensions %d is larger than the %d of the model", dimensions, len(values)),
+			Type:    "invalid_request_error",
+		}
+	}
+
+	truncated := values[:dimensions]
+	var norm float64
+	for _, v := range truncated {
+		norm += float64(v) * float64(v)
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		return truncated, nil
+	}
+
+	normalized := make([]float32, dimensions)
+	for i, v := range truncated {
+		normalized[i] = float32(float64(v) / norm)
+	}
+	return normalized, nil
+}
+
+// uncountedEmbeddingModels holds the models that refused countTokens, they are not asked again
+var uncountedEmbeddingModels sync.Map
+
+// countEmbeddingTokens counts the tokens of the embedded text, embedding responses carry no usage.
+// It asks countTokens of the model and falls back to estimateTokens when the model cannot count.
+func (g *GeminiAdapter) countEmbeddingTokens(ctx context.Context, messages []*genai.Content) int {
+	if _, uncounted := uncountedEmbeddingModels.Load(g.model); !uncounted {
+		var parts []genai.Part
+		for _, message := range messages {
+			parts = append(parts, message.Parts...)
+		}
+
+		resp, err := g.client.GenerativeModel(withModelsPrefix(g.model)).CountTokens(ctx, parts...)
+		if err == nil {
+			return int(resp.TotalTokens)
+		}
+
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && (apiErr.Code == http.StatusBadRequest || apiErr.Code == http.StatusNotFound) {
+			uncountedEmbeddingModels.Store(g.model, true)
+		}
+		log.Printf("count embedding tokens of %s error %v, estimating them\n", g.model, err)
+	}
+	return estimateTokens(messages)
+}
+
+// estimateTokens approximates the tokens of the embedded text at about four characters per token
+func estimateTokens(messages []*genai.Content) int {
+	tokens := 0
+	for _, message := range messages {
+		for _, part := range message.Parts {
+			if text, ok := part.(genai.Text); ok {
+				tokens += (utf8.RuneCountInString(string(text)) + 3) / 4
+			}
+		}
+	}
+	return tokens
+}
+
+// Base64Embedding is an embedding encoded as base64 little endian float32 values
+type Base64Embedding struct {
+	Object    string `json:"object"`
+	Embedding string `json:"embedding"`
+	Index     int    `json:"index"`
+}
+
+// EmbeddingResponseBase64 is the response to an encoding_format=base64 request
+type EmbeddingResponseBase64 struct {
+	Object string                `json:"object"`
+	Data   []Base64Embedding     `json:"data"`
+	Model  openai.EmbeddingModel `json:"model"`
+	Usage  openai.Usage          `json:"usage"`
+}
+
+// EncodeEmbeddingsBase64 packs the embeddings as OpenAI does for encoding_format=base64
+func EncodeEmbeddingsBase64(resp *openai.EmbeddingResponse) *EmbeddingResponseBase64 {
+	encoded := &EmbeddingResponseBase64{
+		Object: resp.Object,
+		Data:   make([]Base64Embedding, 0, len(resp.Data)),
+		Model:  resp.Model,
+		Usage:  resp.Usage,
+	}
+	for _, embedding := range resp.Data {
+		buf := make([]byte, 4*len(embedding.Embedding))
+		for i, v := range embedding.Embedding {
+			binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+		}
+		encoded.Data = append(encoded.Data, Base64Embedding{
+			Object:    embedding.Object,
+			Embedding: base64.StdEncoding.EncodeToString(buf),
+			Index:     embedding.Index,
+		})
+	}
+	return encoded
+}
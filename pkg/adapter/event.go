@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -37,25 +38,56 @@ var (
 	noCache     = []string{"no-cache"}
 )
 
-var dataReplacer = strings.NewReplacer(
-	"\n", "\ndata:",
-	"\r", "\\r")
+var (
+	dataReplacer = strings.NewReplacer(
+		"\n", "\ndata:",
+		"\r", "\\r")
+	fieldReplacer = strings.NewReplacer(
+		"\n", "\\n",
+		"\r", "\\r")
+	commentReplacer = strings.NewReplacer(
+		"\n", "\n: ",
+		"\r", "\\r")
+)
 
+// Event is one server-sent event. Empty fields are left out, and an event with only
+// a Comment is a comment line that clients ignore, such as a keepalive.
 type Event struct {
-	Data interface{}
+	Comment string
+	Event   string
+	ID      string
+	Retry   uint // Reconnection time in milliseconds
+	Data    interface{}
 }
 
 func encode(writer io.Writer, event Event) error {
 	w := checkWriter(writer)
-	return writeData(w, event.Data)
+	if event.Comment != "" {
+		_, _ = w.writeString(": ")
+		_, _ = commentReplacer.WriteString(w, event.Comment)
+		_, _ = w.writeString("\n")
+	}
+	writeField(w, "event", event.Event)
+	writeField(w, "id", event.ID)
+	if event.Retry > 0 {
+		writeField(w, "retry", strconv.FormatUint(uint64(event.Retry), 10))
+	}
+	if event.Data != nil {
+		_, _ = w.writeString("data: ")
+		_, _ = dataReplacer.WriteString(w, fmt.Sprint(event.Data))
+		_, _ = w.writeString("\n")
+	}
+	_, err := w.writeString("\n")
+	return err
 }
 
-func writeData(w stringWriter, data interface{}) error {
-	_, _ = dataReplacer.WriteString(w, fmt.Sprint(data))
-	if strings.HasPrefix(data.(string), "data") {
-		_, _ = w.writeString("\n\n")
+func writeField(w stringWriter, name, value string) {
+	if value == "" {
+		return
 	}
-	return nil
+	_, _ = w.writeString(name + ": ")
+	_, _ = fieldReplacer.WriteString(w, value)
+	_, _ = w.writeString("\n")
 }
 
 func (r Event) Render(w http.ResponseWriter) error {
@@ -0,0 +1,97 @@
+package adapter
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+const (
+	fallbackRuleServerError = "5xx"
+	fallbackRuleSafety      = "safety"
+)
+
+var (
+	// modelFallbacks maps a Gemini model to the ordered models tried when it fails,
+	// e.g. {"gemini-1.5-pro-latest":["gemini-1.5-flash-002"]}
+	modelFallbacks = loadModelFallbacks(os.Getenv("MODEL_FALLBACKS"))
+	fallbackRules  = loadFallbackRules(util.GetEnvString("MODEL_FALLBACK_ON", "429,5xx,safety"))
+)
+
+func loadModelFallbacks(raw string) map[string][]string {
+	fallbacks := map[string][]string{}
+	if raw == "" {
+		return fallbacks
+	}
+
+	if err := json.Unmarshal([]byte(raw), &fallbacks); err != nil {
+		util.ReportConfigError("Invalid MODEL_FALLBACKS, fallback disabled", err)
+		return map[string][]string{}
+	}
+	return fallbacks
+}
+
+func loadFallbackRules(raw string) map[string]bool {
+	rules := map[string]bool{}
+	for _, rule := range strings.Split(raw, ",") {
+		if rule = strings.ToLower(strings.TrimSpace(rule)); rule != "" {
+			rules[rule] = true
+		}
+	}
+	return rules
+}
+
+// GetModelChain returns the model followed by its configured fallbacks, without duplicates
+func GetModelChain(model string) []string {
+	chain := []string{model}
+	seen := map[string]bool{model: true}
+	for _, fallback := range modelFallbacks[model] {
+		if !seen[fallback] {
+			seen[fallback] = true
+			chain = append(chain, fallback)
+		}
+	}
+	return chain
+}
+
+// ModelFallbacks returns the configured fallback lists and the outcomes that trigger them
+func ModelFallbacks() (map[string][]string, []string) {
+	rules := make([]string, 0, len(fallbackRules))
+	for rule := range fallbackRules {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	return modelFallbacks, rules
+}
+
+// shouldFallback reports whether err matches one of the configured fallback rules
+func shouldFallback(err error) bool {
+	// An open circuit or disabled model always reroutes to the next model when one is configured
+	if isUnavailableError(err) {
+		return true
+	}
+
+	var blockedErr *genai.BlockedError
+	if errors.As(err, &blockedErr) {
+		return fallbackRules[fallbackRuleSafety]
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	if fallbackRules[strconv.Itoa(apiErr.Code)] {
+		return true
+	}
+	return apiErr.Code >= http.StatusInternalServerError && fallbackRules[fallbackRuleServerError]
+}
@@ -0,0 +1,400 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/cache"
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+// FetchConfig controls how image and video URLs in messages are downloaded
+type FetchConfig struct {
+	Timeout      time.Duration
+	MaxBytes     int64
+	MaxRedirects int
+	Concurrency  int
+	// Blocklist holds hosts and CIDRs that are refused on top of the private ranges
+	Blocklist []string
+	// Allowlist holds hosts and CIDRs that may be fetched even if they are in a blocked range
+	Allowlist  []string
+	CacheSize  int
+	CacheBytes int
+	CacheTTL   time.Duration
+}
+
+func FetchConfigFromEnv() FetchConfig {
+	return FetchConfig{
+		Timeout:      util.GetEnvDuration("MEDIA_FETCH_TIMEOUT", 15*time.Second),
+		MaxBytes:     int64(util.GetEnvInt("MEDIA_FETCH_MAX_BYTES", 20<<20)),
+		MaxRedirects: util.GetEnvInt("MEDIA_FETCH_MAX_REDIRECTS", 3),
+		Concurrency:  util.GetEnvInt("MEDIA_FETCH_CONCURRENCY", 4),
+		Blocklist:    splitList(util.GetEnvString("MEDIA_FETCH_BLOCKLIST", "")),
+		Allowlist:    splitList(util.GetEnvString("MEDIA_FETCH_ALLOWLIST", "")),
+		CacheSize:    util.GetEnvInt("MEDIA_FETCH_CACHE_SIZE", 100),
+		CacheBytes:   util.GetEnvInt("MEDIA_FETCH_CACHE_BYTES", 100<<20),
+		CacheTTL:     util.GetEnvDuration("MEDIA_FETCH_CACHE_TTL", 10*time.Minute),
+	}
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, strings.ToLower(item))
+		}
+	}
+	return items
+}
+
+var mediaFetcher = newFetcher(FetchConfigFromEnv())
+
+// Ranges that are never fetched unless allowlisted, besides loopback, private, link-local
+// (which includes cloud metadata endpoints), multicast and unspecified addresses
+var blockedCIDRs = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10", // Carrier-grade NAT
+	"192.0.0.0/24",
+	"198.18.0.0/15", // Benchmarking
+	"64:ff9b::/96",  // NAT64, may map to private IPv4
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// fetchedMedia is a downloaded file with its sniffed MIME type
+type fetchedMedia struct {
+	Data     []byte
+	MIMEType string
+	ETag     string
+}
+
+type fetcher struct {
+	cfg       FetchConfig
+	client    *http.Client
+	blocked   []*net.IPNet
+	allowed   []*net.IPNet
+	blockHost map[string]bool
+	allowHost map[string]bool
+
+	// cache holds downloads that have an ETag, they are revalidated with If-None-Match.
+	// It is bounded by CacheBytes as well, so large downloads cannot fill the memory.
+	cache *cache.MemoryCache
+}
+
+func newFetcher(cfg FetchConfig) *fetcher {
+	f := &fetcher{
+		cfg:       cfg,
+		blocked:   blockedCIDRs,
+		blockHost: map[string]bool{},
+		allowHost: map[string]bool{},
+	}
+	for _, item := range cfg.Blocklist {
+		if _, n, err := net.ParseCIDR(item); err == nil {
+			f.blocked = append(f.blocked, n)
+		} else {
+			f.blockHost[item] = true
+		}
+	}
+	for _, item := range cfg.Allowlist {
+		if _, n, err := net.ParseCIDR(item); err == nil {
+			f.allowed = append(f.allowed, n)
+		} else {
+			f.allowHost[item] = true
+		}
+	}
+	if cfg.CacheSize > 0 {
+		f.cache = cache.NewMemoryCacheWithMaxBytes(cfg.CacheSize, cfg.CacheBytes)
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	f.client = &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			// No proxy, it would connect on our behalf and bypass the address checks
+			Proxy: nil,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				ip, err := f.resolve(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+				_, port, _ := net.SplitHostPort(addr)
+				return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			},
+			TLSHandshakeTimeout:   cfg.Timeout,
+			ResponseHeaderTimeout: cfg.Timeout,
+			MaxIdleConnsPerHost:   4,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.MaxRedirects {
+				return errors.Errorf("more than %d redirects", cfg.MaxRedirects)
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+	return f
+}
+
+// resolve looks up the host of addr and returns an address that may be connected to.
+// Checking at dial time also covers redirects and DNS answers that change between lookups.
+func (f *fetcher) resolve(ctx context.Context, addr string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if f.allowHost[strings.ToLower(host)] || f.ipAllowed(ip.IP) {
+			return ip.IP, nil
+		}
+	}
+	return nil, errors.Errorf("host %s resolves to a blocked address", host)
+}
+
+func (f *fetcher) ipAllowed(ip net.IP) bool {
+	for _, n := range f.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range f.blocked {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("scheme %s is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if f.blockHost[host] && !f.allowHost[host] {
+		return errors.Errorf("host %s is blocked", host)
+	}
+	return nil
+}
+
+// Fetch downloads rawURL, the MIME type is sniffed from the content when the server's is missing or generic
+func (f *fetcher) Fetch(ctx context.Context, rawURL string) (*fetchedMedia, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, hasCached := f.cached(rawURL)
+	if hasCached {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && hasCached {
+		return &cached, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	if resp.ContentLength > f.cfg.MaxBytes {
+		return nil, errors.Errorf("larger than %d bytes", f.cfg.MaxBytes)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.cfg.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > f.cfg.MaxBytes {
+		return nil, errors.Errorf("larger than %d bytes", f.cfg.MaxBytes)
+	}
+
+	media := &fetchedMedia{
+		Data:     data,
+		MIMEType: sniffMIMEType(data, resp.Header.Get("Content-Type")),
+		ETag:     resp.Header.Get("ETag"),
+	}
+	if media.ETag != "" {
+		f.store(rawURL, *media)
+	}
+	return media, nil
+}
+
+// cached returns the last download of rawURL, cache entries are stored as etag, MIME type and data
+// separated by NUL bytes
+func (f *fetcher) cached(rawURL string) (fetchedMedia, bool) {
+	if f.cache == nil {
+		return fetchedMedia{}, false
+	}
+	value, ok := f.cache.Get(rawURL)
+	if !ok {
+		return fetchedMedia{}, false
+	}
+
+	fields := bytes.SplitN(value, []byte{0}, 3)
+	if len(fields) != 3 {
+		return fetchedMedia{}, false
+	}
+	return fetchedMedia{ETag: string(fields[0]), MIMEType: string(fields[1]), Data: fields[2]}, true
+}
+
+func (f *fetcher) store(rawURL string, media fetchedMedia) {
+	if f.cache == nil {
+		return
+	}
+	value := make([]byte, 0, len(media.ETag)+len(media.MIMEType)+len(media.Data)+2)
+	value = append(value, media.ETag...)
+	value = append(value, 0)
+	value = append(value, media.MIMEType...)
+	value = append(value, 0)
+	value = append(value, media.Data...)
+	f.cache.Set(rawURL, value, f.cfg.CacheTTL)
+}
+
+// sniffMIMEType prefers the type detected from the content, the header is only used
+// when detection finds nothing more specific than octet-stream or plain text
+func sniffMIMEType(data []byte, header string) string {
+	sniffed := stripMIMEParams(http.DetectContentType(data))
+	if sniffed != "application/octet-stream" && sniffed != "text/plain" {
+		return sniffed
+	}
+	if header = stripMIMEParams(header); header != "" {
+		return header
+	}
+	return sniffed
+}
+
+// remoteMedia holds the downloads of one request by URL
+type remoteMedia struct {
+	ctx   context.Context // Context of the request, URLs that were not downloaded up front are fetched with it
+	byURL map[string]*fetchedMedia
+}
+
+// fetchRemoteMedia downloads every http(s) image and video URL of the request concurrently,
+// except the File API URIs and YouTube links Gemini reads itself
+func (req *ChatCompletionRequest) fetchRemoteMedia(ctx context.Context) (remoteMedia, error) {
+	var urls []string
+	seen := map[string]bool{}
+	for _, message := range req.Messages {
+		parts, err := message.parts()
+		if err != nil {
+			return remoteMedia{}, err
+		}
+		for _, part := range parts {
+			var u string
+			switch {
+			case part.Type == openai.ChatMessagePartTypeImageURL && part.ImageURL != nil:
+				u = part.ImageURL.URL
+			case part.Type == ChatMessagePartTypeVideoURL && part.VideoURL != nil:
+				u = part.VideoURL.URL
+			}
+			if isRemoteURL(u) && !isFileReference(u) && !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+
+	media := remoteMedia{ctx: ctx, byURL: make(map[string]*fetchedMedia, len(urls))}
+	if len(urls) == 0 {
+		return media, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mediaFetcher.cfg.Timeout)
+	defer cancel()
+
+	results := make([]*fetchedMedia, len(urls))
+	errs := make([]error, len(urls))
+	concurrency := mediaFetcher.cfg.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = mediaFetcher.Fetch(ctx, u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	for i, u := range urls {
+		if errs[i] != nil {
+			return remoteMedia{}, errors.Wrapf(errs[i], "failed to fetch %s", u)
+		}
+		media.byURL[u] = results[i]
+	}
+	return media, nil
+}
+
+func isRemoteURL(u string) bool {
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
+
+// get returns the download of u, fetching it if it was not fetched with the request
+func (m remoteMedia) get(u string) (*fetchedMedia, error) {
+	if media, ok := m.byURL[u]; ok {
+		return media, nil
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, mediaFetcher.cfg.Timeout)
+	defer cancel()
+	media, err := mediaFetcher.Fetch(ctx, u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s", u)
+	}
+	return media, nil
+}
+
+// imageFormat returns the image subtype of a MIME type, such as png for image/png
+func imageFormat(mimeType string) (string, error) {
+	format, ok := strings.CutPrefix(mimeType, "image/")
+	if !ok {
+		return "", errors.Errorf("content type %s is not an image", mimeType)
+	}
+	return format, nil
+}
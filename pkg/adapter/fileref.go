@@ -0,0 +1,148 @@
+package adapter
+
+import (
+	"context"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+)
+
+// Media Gemini reads by itself is referenced by URI instead of being downloaded by the proxy:
+// files uploaded with the File API, gs:// objects and YouTube videos.
+
+const (
+	geminiFilesHost = "generativelanguage.googleapis.com"
+	// geminiFilesBaseURL completes File API names such as files/abc123 into URIs
+	geminiFilesBaseURL = "https://" + geminiFilesHost + "/v1beta/"
+)
+
+var youtubeHosts = map[string]bool{
+	"youtube.com":     true,
+	"www.youtube.com": true,
+	"m.youtube.com":   true,
+	"youtu.be":        true,
+}
+
+// isFileReference reports whether u is a File API URI, a gs:// object or a YouTube link
+func isFileReference(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+
+	switch parsed.Scheme {
+	case "gs":
+		return parsed.Host != "" && parsed.Path != ""
+	case "https", "http":
+		host := strings.ToLower(parsed.Hostname())
+		if host == geminiFilesHost {
+			return strings.Contains(parsed.Path, "/files/")
+		}
+		return isYouTubeURL(parsed)
+	}
+	return false
+}
+
+func isYouTubeURL(u *url.URL) bool {
+	if !youtubeHosts[strings.ToLower(u.Hostname())] {
+		return false
+	}
+	if strings.EqualFold(u.Hostname(), "youtu.be") {
+		return len(u.Path) > 1
+	}
+	return u.Path == "/watch" && u.Query().Get("v") != "" ||
+		strings.HasPrefix(u.Path, "/shorts/") ||
+		strings.HasPrefix(u.Path, "/live/")
+}
+
+// fileReferencePart references u by URI. Without mimeType the type comes from the extension of u,
+// YouTube links are sent as video/mp4 and File API URIs are left without a type for resolveFileTypes.
+// Other references whose type cannot be told are refused, Gemini rejects file data without one.
+func fileReferencePart(u, mimeType string) (genai.Part, error) {
+	if mimeType == "" {
+		parsed, _ := url.Parse(u)
+		switch {
+		case isYouTubeURL(parsed):
+			mimeType = "video/mp4"
+		default:
+			mimeType = stripMIMEParams(mime.TypeByExtension(path.Ext(parsed.Path)))
+		}
+		if _, isFileAPI := geminiFileName(u); mimeType == "" && !isFileAPI {
+			return nil, errors.Errorf("the MIME type of %s is unknown, use a URI with a file extension or "+
+				"send it as a file part with a filename", u)
+		}
+	}
+	return genai.FileData{MIMEType: mimeType, URI: u}, nil
+}
+
+// geminiFileName returns the File API name, such as files/abc123, of a File API URI
+func geminiFileName(uri string) (string, bool) {
+	parsed, err := url.Parse(uri)
+	if err != nil || !strings.EqualFold(parsed.Hostname(), geminiFilesHost) {
+		return "", false
+	}
+	i := strings.Index(parsed.Path, "/files/")
+	if i < 0 {
+		return "", false
+	}
+	return parsed.Path[i+1:], true
+}
+
+// resolveFileTypes sets the MIME type of File API URIs referenced without one to the type the file
+// was uploaded with, Gemini rejects file data without a type. The messages are copied before any
+// part is replaced.
+func (g *GeminiAdapter) resolveFileTypes(ctx context.Context, messages []*genai.Content) ([]*genai.Content, error) {
+	var result []*genai.Content // Set once a part is replaced
+	copied := map[int]bool{}
+	types := map[string]string{}
+	for i, content := range messages {
+		for j, part := range content.Parts {
+			fileData, ok := part.(genai.FileData)
+			if !ok || fileData.MIMEType != "" {
+				continue
+			}
+			name, ok := geminiFileName(fileData.URI)
+			if !ok {
+				continue
+			}
+
+			mimeType, ok := types[name]
+			if !ok {
+				file, err := g.client.GetFile(ctx, name)
+				if err != nil {
+					return nil, errors.Wrapf(err, "look up the type of %s", name)
+				}
+				mimeType = file.MIMEType
+				types[name] = mimeType
+			}
+
+			if result == nil {
+				result = append([]*genai.Content(nil), messages...)
+			}
+			if !copied[i] {
+				content := *messages[i]
+				content.Parts = append([]genai.Part(nil), content.Parts...)
+				result[i] = &content
+				copied[i] = true
+			}
+			fileData.MIMEType = mimeType
+			result[i].Parts[j] = fileData
+		}
+	}
+	if result == nil {
+		return messages, nil
+	}
+	return result, nil
+}
+
+// geminiFileURI returns the URI of a File API name such as files/abc123, other references are returned unchanged
+func geminiFileURI(id string) string {
+	if strings.HasPrefix(id, "files/") {
+		return geminiFilesBaseURL + id
+	}
+	return id
+}
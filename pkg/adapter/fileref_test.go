@@ -0,0 +1,40 @@
+package adapter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestFileReferencePartTypes(t *testing.T) {
+	for uri, want := range map[string]string{
+		"gs://bucket/report.pdf":              "application/pdf",
+		"https://www.youtube.com/watch?v=abc": "video/mp4",
+		geminiFilesBaseURL + "files/abc123":   "", // Looked up by resolveFileTypes
+		"https://youtu.be/abc":                "video/mp4",
+		"gs://bucket/clip.mp4":                "video/mp4",
+	} {
+		part, err := fileReferencePart(uri, "")
+		if err != nil {
+			t.Errorf("%s: %v", uri, err)
+			continue
+		}
+		if got := part.(genai.FileData).MIMEType; got != want {
+			t.Errorf("%s: MIME type %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestFileReferencePartRejectsUnknownType(t *testing.T) {
+	_, err := fileReferencePart("gs://bucket/object", "")
+	if err == nil || !strings.Contains(err.Error(), "gs://bucket/object") {
+		t.Fatalf("reference without a known type was not refused with its URI: %v", err)
+	}
+
+	// A type from the client is used as it is
+	part, err := fileReferencePart("gs://bucket/object", "application/pdf")
+	if err != nil || part.(genai.FileData).MIMEType != "application/pdf" {
+		t.Fatalf("supplied MIME type was not used: %v %v", part, err)
+	}
+}
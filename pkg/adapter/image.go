@@ -3,16 +3,25 @@ package adapter
 import (
 	"encoding/base64"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
+
+	"github.com/pkg/errors"
 )
 
-func parseImageURL(imageURL string) ([]byte, string, error) {
+func parseImageURL(imageURL string, media remoteMedia) ([]byte, string, error) {
 	if strings.HasPrefix(imageURL, "data:image/") {
 		return decodeBase64Image(imageURL)
 	}
-	return getImageInfoFromURL(imageURL)
+
+	fetched, err := media.get(imageURL)
+	if err != nil {
+		return nil, "", err
+	}
+	format, err := imageFormat(fetched.MIMEType)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "image_url %s", imageURL)
+	}
+	return fetched.Data, format, nil
 }
 
 func decodeBase64Image(base64String string) ([]byte, string, error) {
@@ -54,36 +63,3 @@ func getBase64ImageFormat(dataURI string) (string, error) {
 
 	return dataURI[startIndex : startIndex+endIndex], nil
 }
-
-func getImageInfoFromURL(url string) ([]byte, string, error) {
-	// Make an HTTP GET request to the URL
-	response, err := http.Get(url)
-	if err != nil {
-		return nil, "", err
-	}
-	defer response.Body.Close()
-
-	// Read the response body
-	imageData, err := io.ReadAll(response.Body)
-	if err != nil {
-		return nil, "", err
-	}
-
-	// Extract image format from the "Content-Type" header
-	contentType := response.Header.Get("Content-Type")
-	format, err := getImageFormatFromContentType(contentType)
-	if err != nil {
-		return nil, "", err
-	}
-
-	return imageData, format, nil
-}
-
-func getImageFormatFromContentType(contentType string) (string, error) {
-	// Extract image format from the "Content-Type" header
-	parts := strings.Split(contentType, "/")
-	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid Content-Type header")
-	}
-	return parts[1], nil
-}
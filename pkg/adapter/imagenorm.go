@@ -0,0 +1,205 @@
+package adapter
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // Registers the GIF decoder, GIFs are converted to PNG
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+	_ "golang.org/x/image/bmp"  // Registers the BMP decoder, BMPs are converted to PNG
+	_ "golang.org/x/image/tiff" // Registers the TIFF decoder, TIFFs are converted to PNG
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+var (
+	// Longest side images are downscaled to for each image_url detail
+	imageLowDetailDimension  = util.GetEnvInt("IMAGE_LOW_DETAIL_DIMENSION", 512)
+	imageAutoDetailDimension = util.GetEnvInt("IMAGE_MAX_DIMENSION", 2048)
+	imageHighDetailDimension = util.GetEnvInt("IMAGE_HIGH_DETAIL_DIMENSION", 3072)
+	// imageMaxPixels refuses images that would take too much memory to decode
+	imageMaxPixels = util.GetEnvInt("IMAGE_MAX_PIXELS", 50_000_000)
+	// imageMaxRequestBytes caps the images of one request after normalization, 0 disables it. It is
+	// above inlineMediaMaxBytes by default, images past the inline limit are uploaded with the File API.
+	imageMaxRequestBytes = util.GetEnvInt("IMAGE_MAX_REQUEST_BYTES", 100<<20)
+)
+
+// Image formats Gemini accepts as they are
+var geminiImageFormats = map[string]bool{
+	"png":  true,
+	"jpeg": true,
+	"webp": true,
+	"heic": true,
+	"heif": true,
+}
+
+// Formats the registered decoders can read, others Gemini does not accept are refused
+var decodableImageFormats = map[string]bool{
+	"png":  true,
+	"jpeg": true,
+	"gif":  true,
+	"bmp":  true,
+	"tiff": true,
+}
+
+const jpegQuality = 90
+
+// normalizeImage converts images Gemini does not accept to PNG and downscales images
+// larger than the detail allows. Other images are returned unchanged.
+func normalizeImage(data []byte, format string, detail openai.ImageURLDetail) ([]byte, string, error) {
+	format = normalizeImageFormat(format)
+	if !decodableImageFormats[format] {
+		if geminiImageFormats[format] {
+			return data, format, nil
+		}
+		return nil, "", errors.Errorf("unsupported image format %s, send PNG, JPEG, WebP, HEIC, GIF, BMP or TIFF", format)
+	}
+
+	cfg, decodedFormat, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "invalid %s image", format)
+	}
+	// Only the header has been read, the pixels are allocated once the size is known to be acceptable
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, "", errors.Errorf("invalid %s image of %dx%d pixels", format, cfg.Width, cfg.Height)
+	}
+	if cfg.Width*cfg.Height > imageMaxPixels {
+		return nil, "", errors.Errorf("image of %dx%d pixels is larger than %d pixels", cfg.Width, cfg.Height, imageMaxPixels)
+	}
+
+	maxDimension := imageDimensionForDetail(detail)
+	width, height := fitDimensions(cfg.Width, cfg.Height, maxDimension)
+	resize := width != cfg.Width || height != cfg.Height
+	if !resize && geminiImageFormats[decodedFormat] {
+		return data, decodedFormat, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "invalid %s image", format)
+	}
+	if resize {
+		img = downscale(img, width, height)
+	}
+
+	// Photos stay JPEG, everything else becomes PNG so transparency and sharp edges survive
+	var buf bytes.Buffer
+	if decodedFormat == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		decodedFormat = "png"
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "encode image")
+	}
+	return buf.Bytes(), decodedFormat, nil
+}
+
+func normalizeImageFormat(format string) string {
+	switch format {
+	case "jpg", "pjpeg":
+		return "jpeg"
+	case "x-ms-bmp", "x-bmp":
+		return "bmp"
+	case "tif", "x-tiff":
+		return "tiff"
+	}
+	return format
+}
+
+func imageDimensionForDetail(detail openai.ImageURLDetail) int {
+	switch detail {
+	case openai.ImageURLDetailLow:
+		return imageLowDetailDimension
+	case openai.ImageURLDetailHigh:
+		return imageHighDetailDimension
+	default:
+		return imageAutoDetailDimension
+	}
+}
+
+// fitDimensions scales width and height down, keeping the aspect ratio, so neither exceeds max
+func fitDimensions(width, height, max int) (int, int) {
+	if max <= 0 || (width <= max && height <= max) {
+		return width, height
+	}
+	if width >= height {
+		return max, maxInt(1, height*max/width)
+	}
+	return maxInt(1, width*max/height), max
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// downscale resizes img by averaging the source pixels covered by each destination pixel
+func downscale(img image.Image, width, height int) image.Image {
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		bounds := img.Bounds()
+		src = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	}
+
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcH/height, (y+1)*srcH/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcW/width, (x+1)*srcW/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					b += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// checkImageBytes enforces imageMaxRequestBytes on the images of the converted messages
+func checkImageBytes(contents []*genai.Content) error {
+	if imageMaxRequestBytes <= 0 {
+		return nil
+	}
+
+	total := 0
+	for _, content := range contents {
+		for _, part := range content.Parts {
+			if blob, ok := part.(genai.Blob); ok && strings.HasPrefix(blob.MIMEType, "image/") {
+				total += len(blob.Data)
+			}
+		}
+	}
+	if total > imageMaxRequestBytes {
+		return errors.Errorf("images of the request take %d bytes, more than the limit of %d", total, imageMaxRequestBytes)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+// inlineMediaMaxBytes is how much media a request may carry inline, Gemini rejects requests over 20MB.
+// Beyond it the largest media are uploaded with the File API and referenced by URI.
+var inlineMediaMaxBytes = util.GetEnvInt("INLINE_MEDIA_MAX_BYTES", 20<<20)
+
+const (
+	// How often an uploaded file is checked while Gemini is still processing it
+	fileProcessingPollInterval = 2 * time.Second
+	// How long deleting an uploaded file may take once its request is done
+	fileDeleteTimeout = 10 * time.Second
+)
+
+var audioMIMETypes = map[string]string{
+	"wav":  "audio/wav",
+	"mp3":  "audio/mp3",
+	"aiff": "audio/aiff",
+	"aac":  "audio/aac",
+	"ogg":  "audio/ogg",
+	"flac": "audio/flac",
+}
+
+func convertInputAudio(audio *ChatMessageInputAudio) (genai.Part, error) {
+	if audio == nil {
+		return nil, errors.New("input_audio part without input_audio")
+	}
+
+	mimeType, ok := audioMIMETypes[strings.ToLower(audio.Format)]
+	if !ok {
+		return nil, errors.Errorf("unsupported input_audio format %q", audio.Format)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(audio.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid input_audio data")
+	}
+	return genai.Blob{MIMEType: mimeType, Data: data}, nil
+}
+
+func convertInputFile(file *ChatMessageFile) (genai.Part, error) {
+	if file == nil {
+		return nil, errors.New("file part without file")
+	}
+
+	// Files already uploaded to Gemini are referenced by their File API name or URI
+	var mimeType string
+	if file.Filename != "" {
+		mimeType = stripMIMEParams(mime.TypeByExtension(path.Ext(file.Filename)))
+	}
+	if isFileReference(file.FileData) {
+		return fileReferencePart(file.FileData, mimeType)
+	}
+	if file.FileData == "" {
+		if file.FileID != "" {
+			if uri := geminiFileURI(file.FileID); isFileReference(uri) {
+				return fileReferencePart(uri, mimeType)
+			}
+			return nil, errors.Errorf("file_id %s is not supported, send the file as file_data or a Gemini file name", file.FileID)
+		}
+		return nil, errors.New("file part without file_data")
+	}
+
+	dataMIMEType, data, err := parseDataURI(file.FileData)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid file_data")
+	}
+	if dataMIMEType != "" {
+		mimeType = dataMIMEType
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	return genai.Blob{MIMEType: stripMIMEParams(mimeType), Data: data}, nil
+}
+
+func convertVideoURL(video *ChatMessageVideoURL, media remoteMedia) (genai.Part, error) {
+	if video == nil {
+		return nil, errors.New("video_url part without video_url")
+	}
+
+	if strings.HasPrefix(video.URL, "data:") {
+		mimeType, data, err := parseDataURI(video.URL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid video_url data")
+		}
+		if mimeType == "" {
+			mimeType = http.DetectContentType(data)
+		}
+		return genai.Blob{MIMEType: stripMIMEParams(mimeType), Data: data}, nil
+	}
+
+	if isFileReference(video.URL) {
+		return fileReferencePart(video.URL, "")
+	}
+
+	fetched, err := media.get(video.URL)
+	if err != nil {
+		return nil, err
+	}
+	return genai.Blob{MIMEType: fetched.MIMEType, Data: fetched.Data}, nil
+}
+
+// parseDataURI decodes a base64 data URI, or plain base64 for which the MIME type is left empty
+func parseDataURI(uri string) (string, []byte, error) {
+	if !strings.HasPrefix(uri, "data:") {
+		data, err := base64.StdEncoding.DecodeString(uri)
+		return "", data, err
+	}
+
+	header, encoded, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return "", nil, errors.New("only base64 data URIs are supported")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSuffix(header, ";base64"), data, nil
+}
+
+func stripMIMEParams(mimeType string) string {
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return mediaType
+	}
+	return mimeType
+}
+
+// uploadLargeMedia moves inline media to the File API, largest first, until the media left inline fit
+// in inlineMediaMaxBytes. The messages are copied before any part is replaced. The returned function
+// deletes the uploaded files and must be called once the request is done with them.
+func (g *GeminiAdapter) uploadLargeMedia(
+	ctx context.Context,
+	messages []*genai.Content,
+) ([]*genai.Content, func(), error) {
+	type blobRef struct {
+		message, part int
+		size          int
+	}
+
+	var (
+		blobs []blobRef
+		total int
+	)
+	for i, content := range messages {
+		for j, part := range content.Parts {
+			if blob, ok := part.(genai.Blob); ok {
+				blobs = append(blobs, blobRef{message: i, part: j, size: len(blob.Data)})
+				total += len(blob.Data)
+			}
+		}
+	}
+	if total <= inlineMediaMaxBytes {
+		return messages, func() {}, nil
+	}
+
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].size > blobs[j].size })
+
+	result := append([]*genai.Content(nil), messages...)
+	copied := map[int]bool{}
+	var uploaded []string
+	for _, ref := range blobs {
+		if total <= inlineMediaMaxBytes {
+			break
+		}
+
+		if !copied[ref.message] {
+			content := *result[ref.message]
+			content.Parts = append([]genai.Part(nil), content.Parts...)
+			result[ref.message] = &content
+			copied[ref.message] = true
+		}
+
+		blob := result[ref.message].Parts[ref.part].(genai.Blob)
+		name, fileData, err := g.uploadBlob(ctx, blob)
+		if name != "" {
+			uploaded = append(uploaded, name)
+		}
+		if err != nil {
+			g.deleteFiles(ctx, uploaded)()
+			return nil, nil, errors.Wrap(err, "upload media to the File API")
+		}
+		result[ref.message].Parts[ref.part] = fileData
+		total -= ref.size
+	}
+	return result, g.deleteFiles(ctx, uploaded), nil
+}
+
+// deleteFiles returns a function deleting the named files once. Uploads would otherwise count
+// against the File API storage of the key until they expire after 48 hours.
+func (g *GeminiAdapter) deleteFiles(ctx context.Context, names []string) func() {
+	// The files are deleted even when the request was cancelled
+	ctx = context.WithoutCancel(ctx)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, name := range names {
+				deleteCtx, cancel := context.WithTimeout(ctx, fileDeleteTimeout)
+				if err := g.client.DeleteFile(deleteCtx, name); err != nil {
+					log.Printf("delete uploaded file %s error %v\n", name, err)
+				}
+				cancel()
+			}
+		})
+	}
+}
+
+// uploadBlob uploads blob and waits until Gemini has processed it. The name of the file is returned
+// whenever it was created, even with an error, so it can be deleted.
+func (g *GeminiAdapter) uploadBlob(ctx context.Context, blob genai.Blob) (string, genai.FileData, error) {
+	file, err := g.client.UploadFile(ctx, "", bytes.NewReader(blob.Data), &genai.UploadFileOptions{
+		MIMEType: blob.MIMEType,
+	})
+	if err != nil {
+		return "", genai.FileData{}, err
+	}
+
+	for file.State == genai.FileStateProcessing {
+		timer := time.NewTimer(fileProcessingPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return file.Name, genai.FileData{}, ctx.Err()
+		case <-timer.C:
+		}
+
+		name := file.Name
+		if file, err = g.client.GetFile(ctx, name); err != nil {
+			return name, genai.FileData{}, err
+		}
+	}
+	if file.State != genai.FileStateActive {
+		return file.Name, genai.FileData{}, errors.Errorf("file %s could not be processed", file.Name)
+	}
+
+	return file.Name, genai.FileData{MIMEType: file.MIMEType, URI: file.URI}, nil
+}
@@ -14,11 +14,12 @@ import (
 )
 
 const (
-	Gemini1Dot5Pro   = "gemini-1.5-pro-latest"
-	Gemini1Dot5Flash = "gemini-1.5-flash-002"
-	Gemini1Dot5ProV  = "gemini-1.0-pro-vision-latest" // Converted to one of the above models in struct::ToGenaiModel
-	Gemini2FlashExp  = "gemini-2.0-flash-exp"
-	TextEmbedding004 = "text-embedding-004"
+	Gemini1Dot5Pro     = "gemini-1.5-pro-latest"
+	Gemini1Dot5Flash   = "gemini-1.5-flash-002"
+	Gemini1Dot5ProV    = "gemini-1.0-pro-vision-latest" // Converted to one of the above models in struct::ToGenaiModel
+	Gemini2FlashExp    = "gemini-2.0-flash-exp"
+	TextEmbedding004   = "text-embedding-004"
+	GeminiEmbedding001 = "gemini-embedding-001"
 )
 
 // GeminiModels stores the available models from Gemini API
@@ -57,6 +58,21 @@ func FetchGeminiModels(ctx context.Context, apiKey string) ([]string, error) {
 	return models, nil
 }
 
+// PingGemini makes the cheapest possible authenticated call, fetching one page of the model list
+func PingGemini(ctx context.Context, apiKey string) error {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, err = client.ListModels(ctx).Next()
+	if err == iterator.Done {
+		return nil
+	}
+	return err
+}
+
 // InitGeminiModels initializes the GeminiModels slice with available models
 func InitGeminiModels(apiKey string) error {
 	var initErr error
@@ -73,6 +89,7 @@ func InitGeminiModels(apiKey string) error {
 				Gemini1Dot5ProV,
 				Gemini2FlashExp,
 				TextEmbedding004,
+				GeminiEmbedding001,
 			}
 			geminiModelsLock.Unlock()
 			initErr = err
@@ -86,13 +103,30 @@ func InitGeminiModels(apiKey string) error {
 	return initErr
 }
 
+// RefreshGeminiModels fetches the model list again and replaces the current catalog
+func RefreshGeminiModels(ctx context.Context, apiKey string) ([]string, error) {
+	models, err := FetchGeminiModels(ctx, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mark the catalog as initialized so a later InitGeminiModels does not overwrite it
+	geminiModelsOnce.Do(func() {})
+
+	geminiModelsLock.Lock()
+	GeminiModels = models
+	geminiModelsLock.Unlock()
+	log.Printf("Refreshed Gemini models: %v\n", models)
+	return models, nil
+}
+
 // GetAvailableGeminiModels returns the available Gemini models
 func GetAvailableGeminiModels() []string {
 	geminiModelsLock.RLock()
 	defer geminiModelsLock.RUnlock()
 
 	if len(GeminiModels) == 0 {
-		return []string{Gemini1Dot5Pro, Gemini1Dot5Flash, Gemini1Dot5ProV, Gemini2FlashExp, TextEmbedding004}
+		return []string{Gemini1Dot5Pro, Gemini1Dot5Flash, Gemini1Dot5ProV, Gemini2FlashExp, TextEmbedding004, GeminiEmbedding001}
 	}
 
 	return GeminiModels
@@ -122,7 +156,8 @@ func IsValidGeminiModel(modelName string) bool {
 			modelName == Gemini1Dot5Flash ||
 			modelName == Gemini1Dot5ProV ||
 			modelName == Gemini2FlashExp ||
-			modelName == TextEmbedding004
+			modelName == TextEmbedding004 ||
+			modelName == GeminiEmbedding001
 	}
 
 	geminiModelsLock.RLock()
@@ -137,6 +172,13 @@ func IsValidGeminiModel(modelName string) bool {
 	return false
 }
 
+// IsEmbeddingModel reports whether the OpenAI or Gemini model name is an embedding model
+func IsEmbeddingModel(modelName string) bool {
+	return strings.HasPrefix(modelName, "text-embedding-") ||
+		strings.HasPrefix(modelName, "gemini-embedding-") ||
+		modelName == "embedding-001"
+}
+
 func GetMappedModel(geminiModelName string) string {
 	if !USE_MODEL_MAPPING {
 		return geminiModelName
@@ -150,6 +192,10 @@ func GetMappedModel(geminiModelName string) string {
 		return openai.GPT4o
 	case geminiModelName == TextEmbedding004:
 		return string(openai.AdaEmbeddingV2)
+	case geminiModelName == GeminiEmbedding001:
+		return string(openai.LargeEmbedding3)
+	case strings.HasPrefix(geminiModelName, "gemini-embedding-"):
+		return geminiModelName
 	default:
 		return openai.GPT3Dot5Turbo
 	}
@@ -163,8 +209,12 @@ func ConvertModel(openAiModelName string) string {
 		return Gemini1Dot5Pro
 	case strings.HasPrefix(openAiModelName, openai.GPT4):
 		return Gemini1Dot5Flash
-	case openAiModelName == string(openai.AdaEmbeddingV2):
+	case openAiModelName == string(openai.AdaEmbeddingV2) || openAiModelName == string(openai.SmallEmbedding3):
 		return TextEmbedding004
+	case openAiModelName == string(openai.LargeEmbedding3):
+		return GeminiEmbedding001
+	case strings.HasPrefix(openAiModelName, "gemini-embedding-"):
+		return openAiModelName
 	case openAiModelName == openai.GPT4o:
 		return Gemini2FlashExp
 	default:
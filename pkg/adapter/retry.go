@@ -0,0 +1,191 @@
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/googleapis/gax-go/v2/apierror"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+// RetryPolicy controls how transient upstream errors are retried
+type RetryPolicy struct {
+	MaxRetries   int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Deadline     time.Duration
+}
+
+type retryPolicyJSON struct {
+	MaxRetries   *int   `json:"max_retries"`
+	InitialDelay string `json:"initial_delay"`
+	MaxDelay     string `json:"max_delay"`
+	Deadline     string `json:"deadline"`
+}
+
+var (
+	defaultRetryPolicy = RetryPolicy{
+		MaxRetries:   util.GetEnvInt("RETRY_MAX_RETRIES", 2),
+		InitialDelay: util.GetEnvDuration("RETRY_INITIAL_DELAY", 500*time.Millisecond),
+		MaxDelay:     util.GetEnvDuration("RETRY_MAX_DELAY", 8*time.Second),
+		Deadline:     util.GetEnvDuration("RETRY_DEADLINE", 5*time.Minute),
+	}
+	modelRetryPolicies = loadModelRetryPolicies(os.Getenv("RETRY_MODEL_POLICIES"))
+)
+
+// loadModelRetryPolicies parses per model overrides such as {"gemini-1.5-pro-latest":{"max_retries":4}}
+func loadModelRetryPolicies(raw string) map[string]RetryPolicy {
+	policies := map[string]RetryPolicy{}
+	if raw == "" {
+		return policies
+	}
+
+	overrides := map[string]retryPolicyJSON{}
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		util.ReportConfigError("Invalid RETRY_MODEL_POLICIES, using defaults", err)
+		return policies
+	}
+
+	for model, override := range overrides {
+		policy := defaultRetryPolicy
+		if override.MaxRetries != nil {
+			policy.MaxRetries = *override.MaxRetries
+		}
+		if d, err := time.ParseDuration(override.InitialDelay); err == nil {
+			policy.InitialDelay = d
+		}
+		if d, err := time.ParseDuration(override.MaxDelay); err == nil {
+			policy.MaxDelay = d
+		}
+		if d, err := time.ParseDuration(override.Deadline); err == nil {
+			policy.Deadline = d
+		}
+		policies[model] = policy
+	}
+	return policies
+}
+
+// GetRetryPolicy returns the retry policy configured for a Gemini model
+func GetRetryPolicy(model string) RetryPolicy {
+	if policy, ok := modelRetryPolicies[model]; ok {
+		return policy
+	}
+	return defaultRetryPolicy
+}
+
+// RetryPolicies returns the default policy under "default" together with the per model overrides
+func RetryPolicies() map[string]RetryPolicy {
+	policies := map[string]RetryPolicy{"default": defaultRetryPolicy}
+	for model, policy := range modelRetryPolicies {
+		policies[model] = policy
+	}
+	return policies
+}
+
+// retryBudget is the retry allowance and deadline of one request. The fallback models and the
+// parallel calls of emulated n > 1 requests all draw from the same budget.
+type retryBudget struct {
+	mu        sync.Mutex
+	remaining int
+	deadline  time.Time // Zero when the policy has no deadline
+}
+
+func newRetryBudget(p RetryPolicy) *retryBudget {
+	b := &retryBudget{remaining: p.MaxRetries}
+	if p.Deadline > 0 {
+		b.deadline = time.Now().Add(p.Deadline)
+	}
+	return b
+}
+
+// take uses up one retry, it returns false once the budget is spent
+func (b *retryBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remaining <= 0 {
+		return false
+	}
+	b.remaining--
+	return true
+}
+
+// withDeadline bounds ctx, and so every attempt made with it, by the request deadline
+func (b *retryBudget) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, b.deadline)
+}
+
+// Do calls fn until it succeeds, returns a non retryable error, or the retries of the policy or the
+// request budget are spent. It returns the number of retries that were made.
+func (p RetryPolicy) Do(ctx context.Context, budget *retryBudget, fn func(ctx context.Context) error) (int, error) {
+	for retries := 0; ; retries++ {
+		err := fn(ctx)
+		if err == nil || retries >= p.MaxRetries || !isRetryableError(err) || ctx.Err() != nil {
+			return retries, err
+		}
+
+		delay := p.backoff(retries, err)
+		if !budget.deadline.IsZero() && time.Now().Add(delay).After(budget.deadline) {
+			return retries, err
+		}
+		if !budget.take() {
+			return retries, err
+		}
+
+		log.Printf("retrying upstream request in %s after error: %v\n", delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return retries, err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt, preferring the delay requested by the server
+func (p RetryPolicy) backoff(retries int, err error) time.Duration {
+	var apiErr *apierror.APIError
+	if errors.As(err, &apiErr) {
+		if info := apiErr.Details().RetryInfo; info != nil {
+			if delay := info.GetRetryDelay().AsDuration(); delay > 0 {
+				return delay
+			}
+		}
+	}
+
+	delay := p.InitialDelay << retries
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	// Full jitter spreads out retries from concurrent requests
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+func isRetryableError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.Code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,412 @@
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+// Number of characters streamed one event at a time by the char chunking strategy
+const sentenceLength = 1000
+
+// streamBufferSize is how many chunks may wait for a slow client before upstream reads pause
+var streamBufferSize = loadStreamBufferSize(util.GetEnvInt("STREAM_BUFFER_SIZE", 64))
+
+func loadStreamBufferSize(size int) int {
+	if size < 0 {
+		util.ReportConfigError("Invalid STREAM_BUFFER_SIZE, using 64", fmt.Errorf("%d", size))
+		return 64
+	}
+	return size
+}
+
+// streamRelay turns Gemini stream responses into OpenAI chunks that share one completion ID
+type streamRelay struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	model    string
+	respID   string
+	created  int64
+	dataChan chan<- string
+
+	// sendUsage makes every chunk carry usage, null until the final usage chunk
+	sendUsage bool
+
+	// schema is the strict response_format schema each choice is validated against when it finishes
+	schema map[string]any
+}
+
+// relayStreams forwards every upstream stream to dataChan, stream i carries the choices starting at index i.
+// A single stream may carry several candidates itself when n is supported natively.
+// The streams must have been started with ctx. Once ctx is done nothing more is read or sent,
+// and cancel is called when relaying ends so no upstream stream outlives it.
+func relayStreams(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	model string,
+	streams []*upstreamStream,
+	dataChan chan string,
+	sendUsage bool,
+	schema map[string]any,
+) {
+	defer close(dataChan)
+	defer cancel()
+
+	r := &streamRelay{
+		ctx:       ctx,
+		cancel:    cancel,
+		model:     model,
+		respID:    util.GetUUID(),
+		created:   time.Now().Unix(),
+		dataChan:  dataChan,
+		sendUsage: sendUsage,
+		schema:    schema,
+	}
+
+	usages := make([]*genai.UsageMetadata, len(streams))
+	oks := make([]bool, len(streams))
+
+	var wg sync.WaitGroup
+	for i, stream := range streams {
+		wg.Add(1)
+		go func(i int, stream *upstreamStream) {
+			defer wg.Done()
+			usages[i], oks[i] = r.relay(stream, i)
+		}(i, stream)
+	}
+	wg.Wait()
+
+	var usage *genai.UsageMetadata
+	for i := range streams {
+		if !oks[i] || ctx.Err() != nil {
+			return
+		}
+		usage = addUsageMetadata(usage, usages[i])
+	}
+
+	// per https://community.openai.com/t/usage-stats-now-available-when-using-streaming-with-the-chat-completions-api-or-completions-api/738156
+	// the usage is sent after everything else
+	if sendUsage && usage != nil {
+		chunk := r.chunk()
+		chunk.Usage = &openai.Usage{
+			PromptTokens:     int(usage.PromptTokenCount),
+			CompletionTokens: int(usage.CandidatesTokenCount),
+			TotalTokens:      int(usage.TotalTokenCount),
+		}
+		r.send(chunk)
+	}
+}
+
+// relay forwards one upstream stream, offset is added to the candidate indexes of the stream.
+// It returns the latest usage metadata and whether the stream ended without error.
+func (r *streamRelay) relay(stream *upstreamStream, offset int) (*genai.UsageMetadata, bool) {
+	var usageMetadata *genai.UsageMetadata
+
+	// Text held back by the chunking strategy, per choice index
+	chunkers := map[int]textChunker{}
+	chunker := func(index int) textChunker {
+		if chunkers[index] == nil {
+			chunkers[index] = newTextChunker(GetChunkingConfig(r.model))
+		}
+		return chunkers[index]
+	}
+	finished := map[int]bool{}
+	texts := map[int]*strings.Builder{}
+	// Tool calls streamed so far, per choice index
+	toolCallCounts := map[int]int{}
+	// Choices whose assistant role chunk was sent
+	started := map[int]bool{}
+
+	results := stream.read(r.ctx)
+	for {
+		if r.ctx.Err() != nil {
+			// The client went away or another stream failed
+			return usageMetadata, false
+		}
+
+		// Text held by time chunking is sent when its window ends, even while upstream is quiet
+		var (
+			flushTimer *time.Timer
+			flush      <-chan time.Time
+		)
+		if due := nextFlush(chunkers, finished); !due.IsZero() {
+			flushTimer = time.NewTimer(time.Until(due))
+			flush = flushTimer.C
+		}
+
+		var (
+			result   upstreamResult
+			received bool
+		)
+		select {
+		case <-r.ctx.Done():
+		case <-flush:
+			for index, c := range chunkers {
+				if !finished[index] {
+					for _, chunk := range c.Write("") {
+						r.sendContent(index, chunk)
+					}
+				}
+			}
+		case result = <-results:
+			received = true
+		}
+		if flushTimer != nil {
+			flushTimer.Stop()
+		}
+		if !received {
+			continue
+		}
+
+		genaiResp, err := result.resp, result.err
+		if err == iterator.Done {
+			for index, c := range chunkers {
+				if !finished[index] {
+					r.sendContent(index, c.Flush())
+				}
+			}
+			// A choice that called tools must still be finished when the stream ends without a finish reason
+			for index := range toolCallCounts {
+				if !finished[index] {
+					r.sendChoice(index, CompletionDelta{}, openai.FinishReasonToolCalls)
+				}
+			}
+			return usageMetadata, true
+		}
+		if err != nil {
+			if r.ctx.Err() == nil {
+				r.sendError(err)
+				// The error ends the response, so the other streams are stopped too
+				r.cancel()
+			}
+			return usageMetadata, false
+		}
+
+		// gemini returns the usage data on each response, adding to it each time, so always get the latest
+		if genaiResp.UsageMetadata != nil {
+			usageMetadata = genaiResp.UsageMetadata
+		}
+
+		for _, candidate := range genaiResp.Candidates {
+			index := offset + int(candidate.Index)
+			isLastMessage := candidate.FinishReason > genai.FinishReasonUnspecified
+
+			if !started[index] {
+				// Like OpenAI, every choice starts with a chunk that only carries the role
+				r.sendChoice(index, CompletionDelta{Role: openai.ChatMessageRoleAssistant}, "")
+				started[index] = true
+			}
+
+			if candidate.Content != nil {
+				for _, part := range candidate.Content.Parts {
+					switch pp := part.(type) {
+					case genai.Text:
+						if r.schema != nil {
+							if texts[index] == nil {
+								texts[index] = &strings.Builder{}
+							}
+							texts[index].WriteString(string(pp))
+						}
+						for _, chunk := range chunker(index).Write(string(pp)) {
+							r.sendContent(index, chunk)
+						}
+					case genai.FunctionCall:
+						// Text before the call is sent first
+						r.sendContent(index, chunker(index).Flush())
+						r.sendToolCall(index, genaiFunctionCallToOpenaiToolCall(pp, toolCallCounts[index]))
+						toolCallCounts[index]++
+					}
+				}
+			}
+
+			if isLastMessage && !finished[index] {
+				r.sendContent(index, chunker(index).Flush())
+				if toolCallCounts[index] > 0 {
+					r.sendChoice(index, CompletionDelta{}, openai.FinishReasonToolCalls)
+					finished[index] = true
+					continue
+				}
+				if r.schema != nil {
+					// Streamed output cannot be regenerated, a mismatch ends the stream with an error
+					var text string
+					if texts[index] != nil {
+						text = texts[index].String()
+					}
+					if err := validateStructuredOutput(text, r.schema); err != nil {
+						r.sendError(schemaMismatchError(errors.Wrapf(err, "choice %d", index)))
+						r.cancel()
+						return usageMetadata, false
+					}
+				}
+				if candidate.FinishReason > genai.FinishReasonStop {
+					log.Printf("genai message finish reason %s\n", candidate.FinishReason.String())
+				}
+				r.sendChoice(index, CompletionDelta{}, convertFinishReason(candidate.FinishReason))
+				finished[index] = true
+			}
+		}
+	}
+}
+
+// upstreamResult is one response, or the error that ended the stream, read from upstream
+type upstreamResult struct {
+	resp *genai.GenerateContentResponse
+	err  error
+}
+
+// read reads the stream on its own goroutine, starting with the first response. Reading ends
+// after the first error, iterator.Done included, or once ctx is done.
+func (s *upstreamStream) read(ctx context.Context) <-chan upstreamResult {
+	results := make(chan upstreamResult)
+	go func() {
+		if s.first != nil {
+			select {
+			case results <- upstreamResult{resp: s.first}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for {
+			resp, err := s.iter.Next()
+			select {
+			case results <- upstreamResult{resp: resp, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// nextFlush returns when the earliest held text of the unfinished choices is due, or the zero time
+func nextFlush(chunkers map[int]textChunker, finished map[int]bool) time.Time {
+	var next time.Time
+	for index, c := range chunkers {
+		timed, ok := c.(timedChunker)
+		if !ok || finished[index] {
+			continue
+		}
+		if due := timed.Due(); !due.IsZero() && (next.IsZero() || due.Before(next)) {
+			next = due
+		}
+	}
+	return next
+}
+
+// sendContent sends a text delta, empty text is not sent
+func (r *streamRelay) sendContent(index int, text string) {
+	if text != "" {
+		r.sendChoice(index, CompletionDelta{Content: text}, "")
+	}
+}
+
+// sendToolCall streams a tool call as a header delta with the id and function name,
+// followed by a delta with the arguments
+func (r *streamRelay) sendToolCall(index int, call openai.ToolCall) {
+	r.sendChoice(index, CompletionDelta{ToolCalls: []ToolCallDelta{{
+		Index:    *call.Index,
+		ID:       call.ID,
+		Type:     call.Type,
+		Function: FunctionCallDelta{Name: call.Function.Name},
+	}}}, "")
+	r.sendChoice(index, CompletionDelta{ToolCalls: []ToolCallDelta{{
+		Index:    *call.Index,
+		Function: FunctionCallDelta{Arguments: call.Function.Arguments},
+	}}}, "")
+}
+
+// sendChoice sends a chunk with a single choice, an empty finishReason leaves finish_reason null
+func (r *streamRelay) sendChoice(index int, delta CompletionDelta, finishReason openai.FinishReason) {
+	choice := CompletionChoice{
+		Index: index,
+		Delta: delta,
+	}
+	if finishReason != "" {
+		reason := string(finishReason)
+		choice.FinishReason = &reason
+	}
+
+	chunk := r.chunk()
+	chunk.Choices = []CompletionChoice{choice}
+	r.send(chunk)
+}
+
+// chunk returns a chunk of this completion without choices
+func (r *streamRelay) chunk() *CompletionResponse {
+	return &CompletionResponse{
+		ID:                fmt.Sprintf("chatcmpl-%s", r.respID),
+		Object:            "chat.completion.chunk",
+		Created:           r.created,
+		Model:             GetMappedModel(r.model),
+		SystemFingerprint: systemFingerprint(r.model),
+		Choices:           []CompletionChoice{},
+		NullUsage:         r.sendUsage,
+	}
+}
+
+// sendError sends err as {"error":{...}}, which OpenAI SDKs raise as an API error
+func (r *streamRelay) sendError(err error) {
+	log.Printf("genai get stream message error %v\n", err)
+
+	// Check for context cancellation
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Context was canceled by client")
+		r.send(ErrorResponse{Error: &openai.APIError{
+			Code:    http.StatusRequestTimeout,
+			Message: "Request was canceled",
+			Type:    "canceled_error",
+		}})
+		return
+	}
+
+	// Errors already converted for the client are sent as they are
+	var openaiErr *openai.APIError
+	if errors.As(err, &openaiErr) {
+		r.send(ErrorResponse{Error: openaiErr})
+		return
+	}
+
+	// Check for rate limit errors
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests {
+		log.Printf("Rate limit exceeded: %v\n", err)
+		r.send(ErrorResponse{Error: &openai.APIError{
+			Code:    http.StatusTooManyRequests,
+			Message: "Rate limit exceeded",
+			Type:    "rate_limit_error",
+		}})
+		return
+	}
+
+	// Handle other errors
+	r.send(ErrorResponse{Error: &openai.APIError{
+		Code:    http.StatusInternalServerError,
+		Message: err.Error(),
+		Type:    "internal_server_error",
+	}})
+}
+
+// send waits for room in dataChan, the chunk is dropped once the stream context is done
+func (r *streamRelay) send(v any) {
+	resp, _ := json.Marshal(v)
+	select {
+	case r.dataChan <- string(resp):
+	case <-r.ctx.Done():
+	}
+}
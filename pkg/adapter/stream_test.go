@@ -0,0 +1,187 @@
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+)
+
+// fakeIterator yields text responses like a Gemini stream started with ctx. After limit responses it
+// ends the stream, or with a negative limit keeps yielding. When stall is set it waits for ctx instead
+// of yielding, like an upstream that stopped sending.
+type fakeIterator struct {
+	ctx   context.Context
+	limit int
+	stall bool
+	sent  int
+}
+
+func (it *fakeIterator) Next() (*genai.GenerateContentResponse, error) {
+	if it.stall {
+		<-it.ctx.Done()
+		return nil, it.ctx.Err()
+	}
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if it.limit >= 0 && it.sent >= it.limit {
+		return nil, iterator.Done
+	}
+	it.sent++
+	return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{
+		Content: &genai.Content{Role: "model", Parts: []genai.Part{genai.Text("chunk ")}},
+	}}}, nil
+}
+
+// startRelay runs relayStreams over the fake streams and returns its channel and a channel
+// closed when relayStreams returned
+func startRelay(ctx context.Context, cancel context.CancelFunc, streams []*fakeIterator, buffer int) (chan string, chan struct{}) {
+	upstream := make([]*upstreamStream, len(streams))
+	for i, it := range streams {
+		upstream[i] = &upstreamStream{iter: it}
+	}
+
+	dataChan := make(chan string, buffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relayStreams(ctx, cancel, "gemini-1.5-flash-latest", upstream, dataChan, false, nil)
+	}()
+	return dataChan, done
+}
+
+func waitDone(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("relayStreams did not return")
+	}
+}
+
+func TestRelayStreamsStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dataChan, done := startRelay(ctx, cancel, []*fakeIterator{{ctx: ctx, limit: 1}, {ctx: ctx, stall: true}}, 8)
+
+	// The first stream is relayed while the second one waits for upstream
+	select {
+	case <-dataChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no chunk was relayed")
+	}
+
+	cancel()
+	waitDone(t, done)
+
+	for range dataChan {
+		// Chunks queued before the cancel may still be read, then the channel must be closed
+	}
+}
+
+func TestRelayStreamsDoesNotBlockOnFullChannel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dataChan, done := startRelay(ctx, cancel, []*fakeIterator{{ctx: ctx, limit: -1}}, 1)
+
+	// Nobody reads, so the relay fills the channel and has to wait for room
+	deadline := time.Now().Add(2 * time.Second)
+	for len(dataChan) < cap(dataChan) {
+		if time.Now().After(deadline) {
+			t.Fatal("the channel was not filled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	waitDone(t, done)
+}
+
+func TestRelayStreamsLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	streams := []*fakeIterator{{ctx: ctx, limit: -1}, {ctx: ctx, limit: 3}, {ctx: ctx, stall: true}}
+	dataChan, done := startRelay(ctx, cancel, streams, 0)
+
+	for i := 0; i < 5; i++ {
+		<-dataChan
+	}
+	cancel()
+	waitDone(t, done)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines remain after relaying, %d before\n%s",
+				runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoadStreamBufferSize(t *testing.T) {
+	if size := loadStreamBufferSize(-1); size < 0 {
+		t.Fatalf("negative STREAM_BUFFER_SIZE was kept as %d", size)
+	}
+	if size := loadStreamBufferSize(0); size != 0 {
+		t.Fatalf("STREAM_BUFFER_SIZE 0 became %d", size)
+	}
+}
+
+func TestRelayStreamsFlushesTimeChunkingWhileUpstreamIsQuiet(t *testing.T) {
+	const model = "gemini-1.5-flash-latest"
+	saved, hadSaved := modelChunkingConfigs[model]
+	modelChunkingConfigs[model] = ChunkingConfig{Strategy: ChunkingTime, Window: 50 * time.Millisecond}
+	defer func() {
+		if hadSaved {
+			modelChunkingConfigs[model] = saved
+		} else {
+			delete(modelChunkingConfigs, model)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Two quick chunks fall in the same window, then upstream goes quiet
+	first, _ := (&fakeIterator{ctx: ctx, limit: 1}).Next()
+	upstream := []*upstreamStream{{iter: &quietIterator{fakeIterator{ctx: ctx, limit: 1}}, first: first}}
+	dataChan := make(chan string, 8)
+	go relayStreams(ctx, cancel, model, upstream, dataChan, false, nil)
+
+	var contents []string
+	timeout := time.After(2 * time.Second)
+	for len(contents) < 2 {
+		select {
+		case data := <-dataChan:
+			var resp CompletionResponse
+			if err := json.Unmarshal([]byte(data), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Choices) > 0 && resp.Choices[0].Delta.Content != "" {
+				contents = append(contents, resp.Choices[0].Delta.Content)
+			}
+		case <-timeout:
+			t.Fatalf("held text was not flushed while upstream was quiet, got %q", contents)
+		}
+	}
+}
+
+// quietIterator yields like fakeIterator, then waits for ctx instead of ending the stream
+type quietIterator struct {
+	fakeIterator
+}
+
+func (it *quietIterator) Next() (*genai.GenerateContentResponse, error) {
+	resp, err := it.fakeIterator.Next()
+	if err == iterator.Done {
+		<-it.ctx.Done()
+		return nil, it.ctx.Err()
+	}
+	return resp, err
+}
@@ -1,12 +1,16 @@
 package adapter
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
 
 	"github.com/google/generative-ai-go/genai"
 	"github.com/pkg/errors"
 	openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/cache"
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
 )
 
 type ChatCompletionMessage struct {
@@ -34,64 +38,146 @@ type ChatCompletionRequest struct {
 
 // ResponseFormat defines the format of the response
 type ResponseFormat struct {
-	Type string `json:"type,omitempty"`
+	Type       string              `json:"type,omitempty"`
+	JSONSchema *ResponseJSONSchema `json:"json_schema,omitempty"`
+}
+
+// ResponseJSONSchema is the schema of a json_schema response format
+type ResponseJSONSchema struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Schema      map[string]any `json:"schema"`
+	Strict      bool           `json:"strict,omitempty"`
 }
 
-func (req *ChatCompletionRequest) ToGenaiMessages() ([]*genai.Content, error) {
-	if req.Model == TextEmbedding004 || req.Model == string(openai.AdaEmbeddingV2) {
+// ToGenaiMessages validates the request and converts its messages, remote media are downloaded with ctx
+func (req *ChatCompletionRequest) ToGenaiMessages(ctx context.Context) ([]*genai.Content, error) {
+	if IsEmbeddingModel(req.Model) {
 		return nil, errors.New("Chat Completion is not supported for embedding model")
 	}
 
-	return req.toVisionGenaiContent()
+	if err := req.validateResponseFormat(); err != nil {
+		return nil, err
+	}
+
+	if _, err := convertOpenAIToolsToGenAI(req.Tools); err != nil {
+		return nil, err
+	}
+
+	return req.toVisionGenaiContent(ctx)
 }
 
-func (req *ChatCompletionRequest) toVisionGenaiContent() ([]*genai.Content, error) {
-	content := make([]*genai.Content, 0, len(req.Messages))
-	for _, message := range req.Messages {
-		var parts []openai.ChatMessagePart
-
-		// Attempt to unmarshal into a slice of parts
-		if err := json.Unmarshal(message.Content, &parts); err != nil {
-			// If it fails, try unmarshalling into a single string
-			var singleString string
-			if err := json.Unmarshal(message.Content, &singleString); err != nil {
-				return nil, errors.Wrap(err, "failed to unmarshal message content")
+// ChatMessagePart is a content part of a message. Besides the go-openai text and image_url parts
+// it carries OpenAI's input_audio and file parts and the video_url extension.
+type ChatMessagePart struct {
+	Type       openai.ChatMessagePartType  `json:"type"`
+	Text       string                      `json:"text,omitempty"`
+	ImageURL   *openai.ChatMessageImageURL `json:"image_url,omitempty"`
+	InputAudio *ChatMessageInputAudio      `json:"input_audio,omitempty"`
+	File       *ChatMessageFile            `json:"file,omitempty"`
+	VideoURL   *ChatMessageVideoURL        `json:"video_url,omitempty"`
+}
+
+const (
+	ChatMessagePartTypeInputAudio openai.ChatMessagePartType = "input_audio"
+	ChatMessagePartTypeFile       openai.ChatMessagePartType = "file"
+	ChatMessagePartTypeVideoURL   openai.ChatMessagePartType = "video_url"
+)
+
+type ChatMessageInputAudio struct {
+	Data   string `json:"data"`   // Base64 encoded audio
+	Format string `json:"format"` // wav, mp3 and the other formats Gemini accepts
+}
+
+type ChatMessageFile struct {
+	FileData string `json:"file_data,omitempty"` // Data URI, plain base64 or a file reference URI
+	FileID   string `json:"file_id,omitempty"`   // Gemini File API name such as files/abc123
+	Filename string `json:"filename,omitempty"`
+}
+
+type ChatMessageVideoURL struct {
+	URL string `json:"url"`
+}
+
+// parts returns the content of the message as parts, a plain string becomes a single text part
+func (message *ChatCompletionMessage) parts() ([]ChatMessagePart, error) {
+	var parts []ChatMessagePart
+
+	// Attempt to unmarshal into a slice of parts
+	if err := json.Unmarshal(message.Content, &parts); err != nil {
+		// If it fails, try unmarshalling into a single string
+		var singleString string
+		if err := json.Unmarshal(message.Content, &singleString); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal message content")
+		}
+
+		if len(message.ToolCalls) == 0 {
+			// Convert single string to a part
+			parts = []ChatMessagePart{
+				{Type: openai.ChatMessagePartTypeText, Text: singleString},
 			}
+		}
+	}
+	return parts, nil
+}
 
-			if len(message.ToolCalls) == 0 {
-				// Convert single string to a part
-				parts = []openai.ChatMessagePart{
-					{Type: openai.ChatMessagePartTypeText, Text: singleString},
-				}
+func (req *ChatCompletionRequest) toVisionGenaiContent(ctx context.Context) ([]*genai.Content, error) {
+	instructionMessages := req.instructionMessages()
+
+	toolCallNames := req.toolCallNames()
+
+	// Remote images and videos of every message are downloaded at once
+	media, err := req.fetchRemoteMedia(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]*genai.Content, 0, len(req.Messages))
+	// Consecutive tool messages are answered in one user turn
+	var toolTurn *toolResultTurn
+	for i, message := range req.Messages {
+		if instructionMessages[i] {
+			// Sent as the SystemInstruction instead of a turn
+			continue
+		}
+
+		if message.Role == openai.ChatMessageRoleTool {
+			if toolTurn == nil {
+				toolTurn = &toolResultTurn{}
+			}
+			if err := toolTurn.add(message, toolCallNames, media); err != nil {
+				return nil, err
 			}
+			continue
+		}
+		if toolTurn != nil {
+			content = append(content, toolTurn.content())
+			toolTurn = nil
+		}
+
+		parts, err := message.parts()
+		if err != nil {
+			return nil, err
 		}
 
 		prompt := make([]genai.Part, 0, len(parts))
 		for _, part := range parts {
 			switch part.Type {
 			case openai.ChatMessagePartTypeText:
-				if message.Role == openai.ChatMessageRoleTool {
-					functionName := message.ToolCallID
-					lastDashIndex := strings.LastIndex(functionName, "-")
-					if lastDashIndex != -1 {
-						functionName = functionName[:lastDashIndex]
-					}
-
-					prompt = append(prompt, genai.FunctionResponse{
-						Name:     functionName,
-						Response: map[string]any{"result": part.Text},
-					})
+				if isSystemRole(message.Role) && systemMessagePolicy != SystemPolicyLegacy {
+					prompt = append(prompt, genai.Text(inlineSystemText(part.Text)))
 				} else {
 					prompt = append(prompt, genai.Text(part.Text))
 				}
 
-			case openai.ChatMessagePartTypeImageURL:
-				data, format, err := parseImageURL(part.ImageURL.URL)
+			default:
+				mediaPart, err := convertMediaPart(part, media)
 				if err != nil {
-					return nil, errors.Wrap(err, "parse image url error")
+					return nil, err
+				}
+				if mediaPart != nil {
+					prompt = append(prompt, mediaPart)
 				}
-
-				prompt = append(prompt, genai.ImageData(format, data))
 			}
 		}
 
@@ -108,7 +194,15 @@ func (req *ChatCompletionRequest) toVisionGenaiContent() ([]*genai.Content, erro
 		}
 
 		switch message.Role {
-		case openai.ChatMessageRoleSystem:
+		case openai.ChatMessageRoleSystem, chatMessageRoleDeveloper:
+			if systemMessagePolicy != SystemPolicyLegacy {
+				content = append(content, &genai.Content{
+					Parts: prompt,
+					Role:  genaiRoleUser,
+				})
+				continue
+			}
+
 			content = append(content, []*genai.Content{
 				{
 					Parts: prompt,
@@ -126,33 +220,172 @@ func (req *ChatCompletionRequest) toVisionGenaiContent() ([]*genai.Content, erro
 				Parts: prompt,
 				Role:  genaiRoleModel,
 			})
-		case openai.ChatMessageRoleUser, openai.ChatMessageRoleTool:
+		case openai.ChatMessageRoleUser:
 			content = append(content, &genai.Content{
 				Parts: prompt,
 				Role:  genaiRoleUser,
 			})
 		}
 	}
+	if toolTurn != nil {
+		content = append(content, toolTurn.content())
+	}
+	if err := checkImageBytes(content); err != nil {
+		return nil, err
+	}
 	return content, nil
 }
 
+// convertMediaPart converts a non-text content part, unknown part types are skipped
+func convertMediaPart(part ChatMessagePart, media remoteMedia) (genai.Part, error) {
+	switch part.Type {
+	case openai.ChatMessagePartTypeImageURL:
+		if part.ImageURL == nil {
+			return nil, errors.New("image_url part without image_url")
+		}
+		if isFileReference(part.ImageURL.URL) {
+			return fileReferencePart(part.ImageURL.URL, "")
+		}
+		data, format, err := parseImageURL(part.ImageURL.URL, media)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse image url error")
+		}
+		data, format, err = normalizeImage(data, format, part.ImageURL.Detail)
+		if err != nil {
+			return nil, err
+		}
+		return genai.ImageData(format, data), nil
+	case ChatMessagePartTypeInputAudio:
+		return convertInputAudio(part.InputAudio)
+	case ChatMessagePartTypeFile:
+		return convertInputFile(part.File)
+	case ChatMessagePartTypeVideoURL:
+		return convertVideoURL(part.VideoURL, media)
+	}
+	return nil, nil
+}
+
+// candidateCount returns the number of choices requested with n, at least one
+func (req *ChatCompletionRequest) candidateCount() int32 {
+	if req.N < 1 {
+		return 1
+	}
+	return req.N
+}
+
+// ContextKey hashes the request without its final message. Semantic cache hits must match it exactly,
+// so only the last user turn is compared by meaning and the history, tools and parameters are not.
+func (req *ChatCompletionRequest) ContextKey() string {
+	history := *req
+	if len(history.Messages) > 0 {
+		history.Messages = history.Messages[:len(history.Messages)-1]
+	}
+	return cache.Key(history)
+}
+
+// LastUserText returns the text of the final message if it is a user turn
+func (req *ChatCompletionRequest) LastUserText() string {
+	if len(req.Messages) == 0 {
+		return ""
+	}
+
+	message := req.Messages[len(req.Messages)-1]
+	if message.Role != openai.ChatMessageRoleUser {
+		return ""
+	}
+
+	var singleString string
+	if err := json.Unmarshal(message.Content, &singleString); err == nil {
+		return singleString
+	}
+
+	var parts []openai.ChatMessagePart
+	if err := json.Unmarshal(message.Content, &parts); err != nil {
+		return ""
+	}
+
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part.Type != openai.ChatMessagePartTypeText {
+			// Turns with images or other media are not comparable by text alone
+			return ""
+		}
+		texts = append(texts, part.Text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+type CompletionDelta struct {
+	Content   string          `json:"content,omitempty"`
+	Role      string          `json:"role,omitempty"`
+	ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+// MarshalJSON sends an empty content together with the role, as in the first chunk of an OpenAI stream
+func (d CompletionDelta) MarshalJSON() ([]byte, error) {
+	type delta CompletionDelta
+	if d.Role != "" {
+		return json.Marshal(struct {
+			delta
+			Content string `json:"content"`
+		}{delta: delta(d), Content: d.Content})
+	}
+	return json.Marshal(delta(d))
+}
+
+// ToolCallDelta is a streamed tool call fragment. The first fragment of a call carries
+// the id, type and function name, later fragments only append to the arguments.
+type ToolCallDelta struct {
+	Index    int               `json:"index"`
+	ID       string            `json:"id,omitempty"`
+	Type     openai.ToolType   `json:"type,omitempty"`
+	Function FunctionCallDelta `json:"function"`
+}
+
+type FunctionCallDelta struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
 type CompletionChoice struct {
-	Index int `json:"index"`
-	Delta struct {
-		Content   string            `json:"content,omitempty"`
-		Role      string            `json:"role,omitempty"`
-		ToolCalls []openai.ToolCall `json:"tool_calls,omitempty"`
-	} `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Delta        CompletionDelta `json:"delta"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type CompletionResponse struct {
-	ID      string             `json:"id"`
-	Object  string             `json:"object"`
-	Created int64              `json:"created"`
-	Model   string             `json:"model"`
-	Choices []CompletionChoice `json:"choices"`
-	Usage   openai.Usage       `json:"usage"`
+	ID                string             `json:"id"`
+	Object            string             `json:"object"`
+	Created           int64              `json:"created"`
+	Model             string             `json:"model"`
+	SystemFingerprint string             `json:"system_fingerprint"`
+	Choices           []CompletionChoice `json:"choices"`
+	Usage             *openai.Usage      `json:"usage,omitempty"`
+
+	// NullUsage sends "usage": null while Usage is nil, as OpenAI does for the chunks
+	// of a stream that reports usage in its last chunk
+	NullUsage bool `json:"-"`
+}
+
+func (r CompletionResponse) MarshalJSON() ([]byte, error) {
+	type response CompletionResponse
+	if r.Usage == nil && r.NullUsage {
+		return json.Marshal(struct {
+			response
+			Usage *openai.Usage `json:"usage"`
+		}{response: response(r)})
+	}
+	return json.Marshal(response(r))
+}
+
+// ErrorResponse is the OpenAI error body, also used for errors in the middle of a stream
+type ErrorResponse struct {
+	Error *openai.APIError `json:"error"`
+}
+
+// systemFingerprint identifies the backend configuration behind a model, like OpenAI's fp_ values
+func systemFingerprint(model string) string {
+	return "fp_" + util.HashKey(model)[:10]
 }
 
 type StringArray []string
@@ -180,12 +413,21 @@ func (s *StringArray) UnmarshalJSON(data []byte) error {
 
 // EmbeddingRequest represents a request structure for embeddings API.
 type EmbeddingRequest struct {
-	Model    string      `json:"model" binding:"required"`
-	Messages StringArray `json:"input" binding:"required,min=1"`
+	Model          string                         `json:"model" binding:"required"`
+	Messages       StringArray                    `json:"input" binding:"required,min=1"`
+	Dimensions     int                            `json:"dimensions,omitempty"`
+	EncodingFormat openai.EmbeddingEncodingFormat `json:"encoding_format,omitempty"`
+	Gemini         *GeminiEmbeddingOptions        `json:"gemini,omitempty"` // Gemini only parameters
+}
+
+// GeminiEmbeddingOptions are the embedding parameters Gemini has and OpenAI does not
+type GeminiEmbeddingOptions struct {
+	TaskType string `json:"task_type,omitempty"` // Such as RETRIEVAL_QUERY or SEMANTIC_SIMILARITY
+	Title    string `json:"title,omitempty"`     // Title of the documents, implies RETRIEVAL_DOCUMENT
 }
 
 func (req *EmbeddingRequest) ToGenaiMessages() ([]*genai.Content, error) {
-	if req.Model != TextEmbedding004 && req.Model != string(openai.AdaEmbeddingV2) {
+	if !IsEmbeddingModel(req.Model) {
 		return nil, errors.New("Embedding is not supported for chat model " + req.Model)
 	}
 
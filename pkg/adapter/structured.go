@@ -0,0 +1,345 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+const (
+	ResponseFormatText       = "text"
+	ResponseFormatJSON       = "json" // Accepted for backwards compatibility
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+// structuredOutputRetries is how many times a strict json_schema response is regenerated when it does not match
+var structuredOutputRetries = util.GetEnvInt("STRUCTURED_OUTPUT_RETRIES", 1)
+
+func (req *ChatCompletionRequest) validateResponseFormat() error {
+	if req.ResponseFormat == nil {
+		return nil
+	}
+
+	switch req.ResponseFormat.Type {
+	case "", ResponseFormatText, ResponseFormatJSON, ResponseFormatJSONObject:
+		return nil
+	case ResponseFormatJSONSchema:
+		if req.ResponseFormat.JSONSchema == nil || req.ResponseFormat.JSONSchema.Schema == nil {
+			return errors.New("response_format.json_schema.schema is required for json_schema")
+		}
+		if _, err := convertJSONSchemaToGenAISchema(req.ResponseFormat.JSONSchema.Schema); err != nil {
+			return errors.Wrap(err, "response_format.json_schema")
+		}
+		return nil
+	default:
+		return errors.Errorf("unsupported response_format type %q", req.ResponseFormat.Type)
+	}
+}
+
+func setGenaiResponseFormat(model *genai.GenerativeModel, req *ChatCompletionRequest) {
+	if req.ResponseFormat == nil {
+		return
+	}
+
+	switch req.ResponseFormat.Type {
+	case ResponseFormatJSON, ResponseFormatJSONObject:
+		model.ResponseMIMEType = "application/json"
+	case ResponseFormatJSONSchema:
+		model.ResponseMIMEType = "application/json"
+		// Conversion issues are rejected by validateResponseFormat before the model is built
+		model.ResponseSchema, _ = convertJSONSchemaToGenAISchema(req.ResponseFormat.JSONSchema.Schema)
+	}
+}
+
+// strictSchema returns the schema the output must be validated against, or nil when validation is off
+func (req *ChatCompletionRequest) strictSchema() map[string]any {
+	if req.ResponseFormat == nil || req.ResponseFormat.Type != ResponseFormatJSONSchema ||
+		req.ResponseFormat.JSONSchema == nil || !req.ResponseFormat.JSONSchema.Strict {
+		return nil
+	}
+	return req.ResponseFormat.JSONSchema.Schema
+}
+
+// validateStructuredOutput checks that text is JSON matching schema
+func validateStructuredOutput(text string, schema map[string]any) error {
+	var value any
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return errors.Wrap(err, "output is not valid JSON")
+	}
+	return validateJSONSchema(value, schema, schema, "$", nil)
+}
+
+// validateChoices validates the text of every choice without tool calls
+func validateChoices(resp *openai.ChatCompletionResponse, schema map[string]any) error {
+	for _, choice := range resp.Choices {
+		if len(choice.Message.ToolCalls) > 0 {
+			continue
+		}
+		if err := validateStructuredOutput(choice.Message.Content, schema); err != nil {
+			return errors.Wrapf(err, "choice %d", choice.Index)
+		}
+	}
+	return nil
+}
+
+// schemaMismatchError is returned to the client when strict output still does not match after retries
+func schemaMismatchError(err error) error {
+	return &openai.APIError{
+		Code:    http.StatusInternalServerError,
+		Message: "model output does not match the response_format schema: " + err.Error(),
+		Type:    "server_error",
+	}
+}
+
+// validateJSONSchema validates value against the subset of JSON Schema used by structured outputs.
+// refs holds the $ref values already followed for this value, a reference reached twice without
+// descending into a property or item would recurse forever.
+func validateJSONSchema(value any, schema, root map[string]any, path string, refs map[string]bool) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		if refs[ref] {
+			return errors.Errorf("%s: $ref %s refers to itself", path, ref)
+		}
+		resolved, err := resolveSchemaRef(ref, root)
+		if err != nil {
+			return err
+		}
+		if refs == nil {
+			refs = map[string]bool{}
+		}
+		refs[ref] = true
+		defer delete(refs, ref)
+		return validateJSONSchema(value, resolved, root, path, refs)
+	}
+
+	if options, ok := schema["anyOf"].([]any); ok {
+		return validateAnyOf(value, options, root, path, refs)
+	}
+	if options, ok := schema["oneOf"].([]any); ok {
+		return validateAnyOf(value, options, root, path, refs)
+	}
+
+	if c, ok := schema["const"]; ok && !jsonEqual(value, c) {
+		return errors.Errorf("%s must be %v", path, c)
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(value, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("%s must be one of %v", path, enum)
+		}
+	}
+
+	if types := schemaTypes(schema); len(types) > 0 {
+		matched := false
+		for _, t := range types {
+			if jsonTypeMatches(value, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return errors.Errorf("%s must be of type %s", path, strings.Join(types, " or "))
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		return validateObject(v, schema, root, path)
+	case []any:
+		return validateArray(v, schema, root, path)
+	case string:
+		return validateString(v, schema, path)
+	case float64:
+		return validateNumber(v, schema, path)
+	}
+	return nil
+}
+
+func validateAnyOf(value any, options []any, root map[string]any, path string, refs map[string]bool) error {
+	for _, option := range options {
+		if optionSchema, ok := option.(map[string]any); ok {
+			if validateJSONSchema(value, optionSchema, root, path, refs) == nil {
+				return nil
+			}
+		}
+	}
+	return errors.Errorf("%s does not match any allowed schema", path)
+}
+
+func validateObject(v map[string]any, schema, root map[string]any, path string) error {
+	properties, _ := schema["properties"].(map[string]any)
+
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, exists := v[name]; !exists {
+					return errors.Errorf("%s.%s is required", path, name)
+				}
+			}
+		}
+	}
+
+	for name, propValue := range v {
+		if propSchema, ok := properties[name].(map[string]any); ok {
+			if err := validateJSONSchema(propValue, propSchema, root, path+"."+name, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return errors.Errorf("%s.%s is not allowed", path, name)
+			}
+		case map[string]any:
+			if err := validateJSONSchema(propValue, additional, root, path+"."+name, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateArray(v []any, schema, root map[string]any, path string) error {
+	if min, ok := schema["minItems"].(float64); ok && float64(len(v)) < min {
+		return errors.Errorf("%s must have at least %v items", path, min)
+	}
+	if max, ok := schema["maxItems"].(float64); ok && float64(len(v)) > max {
+		return errors.Errorf("%s must have at most %v items", path, max)
+	}
+
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range v {
+			if err := validateJSONSchema(item, items, root, fmt.Sprintf("%s[%d]", path, i), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(v string, schema map[string]any, path string) error {
+	length := float64(len([]rune(v)))
+	if min, ok := schema["minLength"].(float64); ok && length < min {
+		return errors.Errorf("%s must be at least %v characters", path, min)
+	}
+	if max, ok := schema["maxLength"].(float64); ok && length > max {
+		return errors.Errorf("%s must be at most %v characters", path, max)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+			return errors.Errorf("%s must match %s", path, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(v float64, schema map[string]any, path string) error {
+	if min, ok := schema["minimum"].(float64); ok && v < min {
+		return errors.Errorf("%s must be >= %v", path, min)
+	}
+	if max, ok := schema["maximum"].(float64); ok && v > max {
+		return errors.Errorf("%s must be <= %v", path, max)
+	}
+	if min, ok := schema["exclusiveMinimum"].(float64); ok && v <= min {
+		return errors.Errorf("%s must be > %v", path, min)
+	}
+	if max, ok := schema["exclusiveMaximum"].(float64); ok && v >= max {
+		return errors.Errorf("%s must be < %v", path, max)
+	}
+	return nil
+}
+
+// schemaTypes returns the allowed types, "type" may be a single type or a list such as ["string","null"]
+func schemaTypes(schema map[string]any) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []any:
+		types := make([]string, 0, len(t))
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func jsonTypeMatches(value any, t string) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func jsonEqual(a, b any) bool {
+	aJSON, _ := json.Marshal(a)
+	bJSON, _ := json.Marshal(b)
+	return string(aJSON) == string(bJSON)
+}
+
+// resolveSchemaRef resolves local references such as #/$defs/Item or #/definitions/Item
+func resolveSchemaRef(ref string, root map[string]any) (map[string]any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, errors.Errorf("only local $ref values are supported, got %s", ref)
+	}
+
+	var node any = root
+	for _, token := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, errors.Errorf("cannot resolve $ref %s", ref)
+		}
+		if node, ok = m[token]; !ok {
+			return nil, errors.Errorf("cannot resolve $ref %s", ref)
+		}
+	}
+
+	resolved, ok := node.(map[string]any)
+	if !ok {
+		return nil, errors.Errorf("$ref %s does not point to a schema", ref)
+	}
+	return resolved, nil
+}
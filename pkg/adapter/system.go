@@ -0,0 +1,98 @@
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+const chatMessageRoleDeveloper = "developer"
+
+// How system and developer messages that appear after the conversation started are handled.
+// Leading system messages always become the SystemInstruction, except with the legacy policy.
+const (
+	// SystemPolicyMerge appends them to the SystemInstruction
+	SystemPolicyMerge = "merge"
+	// SystemPolicyInline keeps them in place as user turns wrapped in <system> tags
+	SystemPolicyInline = "inline"
+	// SystemPolicyLegacy sends every system message as a user turn followed by an empty model turn
+	SystemPolicyLegacy = "legacy"
+)
+
+var systemMessagePolicy = loadSystemMessagePolicy(util.GetEnvString("SYSTEM_MESSAGE_POLICY", SystemPolicyMerge))
+
+func loadSystemMessagePolicy(policy string) string {
+	switch policy {
+	case SystemPolicyMerge, SystemPolicyInline, SystemPolicyLegacy:
+		return policy
+	}
+	util.ReportConfigError("Invalid SYSTEM_MESSAGE_POLICY, using merge", fmt.Errorf("%q", policy))
+	return SystemPolicyMerge
+}
+
+func isSystemRole(role string) bool {
+	return role == openai.ChatMessageRoleSystem || role == chatMessageRoleDeveloper
+}
+
+// instructionMessages returns the indexes of the messages that belong in the SystemInstruction.
+// A request made only of system messages has no turn to send, so they are all inlined instead.
+func (req *ChatCompletionRequest) instructionMessages() map[int]bool {
+	if systemMessagePolicy == SystemPolicyLegacy {
+		return nil
+	}
+
+	indexes := map[int]bool{}
+	leading, hasConversation := true, false
+	for i, message := range req.Messages {
+		if !isSystemRole(message.Role) {
+			leading, hasConversation = false, true
+			continue
+		}
+		if leading || systemMessagePolicy != SystemPolicyInline {
+			indexes[i] = true
+		}
+	}
+
+	if !hasConversation {
+		return nil
+	}
+	return indexes
+}
+
+// toGenaiSystemInstruction collects the text of the instruction messages, it returns nil if there are none
+func (req *ChatCompletionRequest) toGenaiSystemInstruction() (*genai.Content, error) {
+	indexes := req.instructionMessages()
+	if len(indexes) == 0 {
+		return nil, nil
+	}
+
+	instruction := &genai.Content{}
+	for i, message := range req.Messages {
+		if !indexes[i] {
+			continue
+		}
+
+		parts, err := message.parts()
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts {
+			if part.Type == openai.ChatMessagePartTypeText {
+				instruction.Parts = append(instruction.Parts, genai.Text(part.Text))
+			}
+		}
+	}
+
+	if len(instruction.Parts) == 0 {
+		return nil, nil
+	}
+	return instruction, nil
+}
+
+// inlineSystemText wraps a system message kept in the conversation so the model can tell it apart from the user
+func inlineSystemText(text string) string {
+	return fmt.Sprintf("<system>\n%s\n</system>", text)
+}
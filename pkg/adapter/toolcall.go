@@ -0,0 +1,135 @@
+package adapter
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/cache"
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+// toolCallRegistry remembers the function name of every tool call ID handed out, for clients
+// that send tool results without the assistant message that made the call. A size of 0 disables it.
+var (
+	toolCallRegistryTTL = util.GetEnvDuration("TOOL_CALL_REGISTRY_TTL", time.Hour)
+	toolCallRegistry    = newToolCallRegistry(util.GetEnvInt("TOOL_CALL_REGISTRY_SIZE", 10000))
+)
+
+// Tool call IDs of older versions of the proxy, the function name followed by the part index
+var legacyToolCallID = regexp.MustCompile(`^(.+)-\d+$`)
+
+func newToolCallRegistry(size int) *cache.MemoryCache {
+	if size <= 0 {
+		return nil
+	}
+	return cache.NewMemoryCache(size)
+}
+
+// newToolCallID returns an OpenAI style tool call ID and registers the function name it belongs to
+func newToolCallID(functionName string) string {
+	id := "call_" + util.GetUUID()[:24]
+	if toolCallRegistry != nil {
+		toolCallRegistry.Set(id, []byte(functionName), toolCallRegistryTTL)
+	}
+	return id
+}
+
+// toolCallNames maps the IDs of the tool calls made by assistant messages to their function names
+func (req *ChatCompletionRequest) toolCallNames() map[string]string {
+	names := map[string]string{}
+	for _, message := range req.Messages {
+		if message.Role != openai.ChatMessageRoleAssistant {
+			continue
+		}
+		for _, call := range message.ToolCalls {
+			if call.ID != "" {
+				names[call.ID] = call.Function.Name
+			}
+		}
+	}
+	return names
+}
+
+// resolveToolCallName returns the function name a tool result answers. The assistant tool calls of
+// the conversation come first, then the registry, then the legacy name-index ID format.
+func resolveToolCallName(toolCallID string, names map[string]string) (string, error) {
+	if name, ok := names[toolCallID]; ok {
+		return name, nil
+	}
+	if toolCallRegistry != nil {
+		if name, ok := toolCallRegistry.Get(toolCallID); ok {
+			return string(name), nil
+		}
+	}
+	if m := legacyToolCallID.FindStringSubmatch(toolCallID); m != nil {
+		return m[1], nil
+	}
+	return "", errors.Errorf("cannot resolve tool_call_id %q to a function, include the assistant message with its tool_calls", toolCallID)
+}
+
+// toolResultTurn collects consecutive tool messages into one user turn. The function responses
+// come first and the images returned by the tools follow them.
+type toolResultTurn struct {
+	responses []genai.Part
+	media     []genai.Part
+}
+
+func (t *toolResultTurn) add(message ChatCompletionMessage, names map[string]string, media remoteMedia) error {
+	functionName, err := resolveToolCallName(message.ToolCallID, names)
+	if err != nil {
+		return err
+	}
+
+	parts, err := message.parts()
+	if err != nil {
+		return err
+	}
+
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part.Type == openai.ChatMessagePartTypeText {
+			texts = append(texts, part.Text)
+			continue
+		}
+
+		mediaPart, err := convertMediaPart(part, media)
+		if err != nil {
+			return err
+		}
+		if mediaPart != nil {
+			t.media = append(t.media, mediaPart)
+		}
+	}
+
+	t.responses = append(t.responses, genai.FunctionResponse{
+		Name:     functionName,
+		Response: toolResultResponse(strings.Join(texts, "\n")),
+	})
+	return nil
+}
+
+func (t *toolResultTurn) content() *genai.Content {
+	return &genai.Content{
+		Parts: append(t.responses, t.media...),
+		Role:  genaiRoleUser,
+	}
+}
+
+// toolResultResponse passes a JSON object result through as the response,
+// any other result is wrapped as {"result": value}
+func toolResultResponse(text string) map[string]any {
+	var value any
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return map[string]any{"result": text}
+	}
+	if object, ok := value.(map[string]any); ok {
+		return object
+	}
+	return map[string]any{"result": value}
+}
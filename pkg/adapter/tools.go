@@ -3,137 +3,490 @@ package adapter
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// SchemaConversionError lists the JSON schema constructs that cannot be expressed as a Gemini schema
+type SchemaConversionError struct {
+	Issues []string
+}
+
+func (e *SchemaConversionError) Error() string {
+	return "unsupported JSON schema constructs: " + strings.Join(e.Issues, "; ")
+}
+
+// Keywords Gemini has no equivalent for that can be dropped without changing what is valid output
+var ignoredSchemaKeywords = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "$defs": true, "definitions": true,
+	"title": true, "default": true, "examples": true, "readOnly": true, "writeOnly": true,
+	"deprecated": true, "propertyNames": true, "unevaluatedProperties": true, "dependentRequired": true,
+	"dependencies": true, "minProperties": true, "maxProperties": true, "uniqueItems": true,
+	"contentEncoding": true, "contentMediaType": true, "strict": true,
+}
+
+// Keywords that are kept as hints in the description because Gemini cannot enforce them
+var describedSchemaKeywords = []string{
+	"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf",
+	"minLength", "maxLength", "pattern", "minItems", "maxItems",
+}
+
+// Keywords handled by the converter itself
+var convertedSchemaKeywords = map[string]bool{
+	"type": true, "description": true, "format": true, "enum": true, "const": true, "nullable": true,
+	"items": true, "properties": true, "required": true, "$ref": true, "anyOf": true, "oneOf": true, "allOf": true,
+	"additionalProperties": true, "patternProperties": true,
+}
+
+// Formats the Gemini API understands for each type, other formats become description hints
+var supportedSchemaFormats = map[genai.Type]map[string]bool{
+	genai.TypeString:  {"enum": true, "date-time": true},
+	genai.TypeInteger: {"int32": true, "int64": true},
+	genai.TypeNumber:  {"float": true, "double": true},
+}
+
 // convertOpenAIToolsToGenAI converts OpenAI tools to Gemini tools
-func convertOpenAIToolsToGenAI(tools []openai.Tool) []*genai.Tool {
+func convertOpenAIToolsToGenAI(tools []openai.Tool) ([]*genai.Tool, error) {
 	var result []*genai.Tool
+	var issues []string
 
 	for _, tool := range tools {
-		if tool.Type != openai.ToolTypeFunction {
+		if tool.Type != openai.ToolTypeFunction || tool.Function == nil {
 			continue // Only support function tools for now
 		}
 
-		// Convert parameters to Gemini schema
-		paramsMap, ok := tool.Function.Parameters.(map[string]interface{})
-		if !ok {
-			// If it's not already a map, try to convert it using json
-			paramsBytes, err := json.Marshal(tool.Function.Parameters)
-			if err != nil {
-				continue // Skip this tool if we can't convert parameters
+		declaration := &genai.FunctionDeclaration{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+		}
+
+		if tool.Function.Parameters != nil {
+			// Convert parameters to Gemini schema
+			paramsMap, ok := tool.Function.Parameters.(map[string]any)
+			if !ok {
+				// If it's not already a map, try to convert it using json
+				paramsBytes, err := json.Marshal(tool.Function.Parameters)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid parameters for tool %s", tool.Function.Name)
+				}
+				if err := json.Unmarshal(paramsBytes, &paramsMap); err != nil {
+					return nil, errors.Wrapf(err, "invalid parameters for tool %s", tool.Function.Name)
+				}
 			}
 
-			var convertedParams map[string]interface{}
-			if err := json.Unmarshal(paramsBytes, &convertedParams); err != nil {
-				continue // Skip this tool if we can't convert parameters
+			schema, err := convertJSONSchemaToGenAISchema(paramsMap)
+			var convErr *SchemaConversionError
+			if errors.As(err, &convErr) {
+				for _, issue := range convErr.Issues {
+					issues = append(issues, fmt.Sprintf("tool %s: %s", tool.Function.Name, issue))
+				}
+			}
+
+			// A function without parameters must not declare an empty object
+			if schema != nil && (schema.Type != genai.TypeObject || len(schema.Properties) > 0) {
+				declaration.Parameters = schema
 			}
-			paramsMap = convertedParams
 		}
 
-		schema := convertJSONSchemaToGenAISchema(paramsMap)
+		result = append(result, &genai.Tool{
+			FunctionDeclarations: []*genai.FunctionDeclaration{declaration},
+		})
+	}
+
+	if len(issues) > 0 {
+		return result, &SchemaConversionError{Issues: issues}
+	}
+	return result, nil
+}
+
+// convertJSONSchemaToGenAISchema converts a JSON schema to Gemini schema. Local $ref values are
+// inlined, constraints Gemini cannot enforce are kept as description hints, and constructs that
+// cannot be approximated are reported in a SchemaConversionError next to the best effort schema.
+func convertJSONSchemaToGenAISchema(schema map[string]any) (*genai.Schema, error) {
+	c := &schemaConverter{root: schema, resolving: map[string]bool{}}
+	result := c.convert(schema, "$")
+	if len(c.issues) > 0 {
+		sort.Strings(c.issues)
+		return result, &SchemaConversionError{Issues: c.issues}
+	}
+	return result, nil
+}
+
+type schemaConverter struct {
+	root      map[string]any
+	issues    []string
+	resolving map[string]bool // $ref values being inlined, to detect cycles
+}
+
+func (c *schemaConverter) fail(path, format string, args ...any) {
+	c.issues = append(c.issues, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (c *schemaConverter) convert(schema map[string]any, path string) *genai.Schema {
+	if ref, ok := schema["$ref"].(string); ok {
+		return c.convertRef(ref, schema, path)
+	}
+	if _, ok := schema["allOf"]; ok {
+		return c.convertAllOf(schema, path)
+	}
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		if options, ok := schema[keyword].([]any); ok {
+			return c.convertUnion(keyword, options, schema, path)
+		}
+	}
 
-		item := &genai.Tool{
-			FunctionDeclarations: []*genai.FunctionDeclaration{{
-				Name:        tool.Function.Name,
-				Description: tool.Function.Description,
-				Parameters:  schema,
-			}},
+	for keyword := range schema {
+		if !convertedSchemaKeywords[keyword] && !ignoredSchemaKeywords[keyword] && !isDescribedKeyword(keyword) {
+			c.fail(path, "%s is not supported", keyword)
 		}
-		result = append(result, item)
 	}
 
+	result := &genai.Schema{}
+	if desc, ok := schema["description"].(string); ok {
+		result.Description = desc
+	}
+	if nullable, ok := schema["nullable"].(bool); ok {
+		result.Nullable = nullable
+	}
+
+	result.Type = c.convertType(schema, result, path)
+
+	switch result.Type {
+	case genai.TypeObject:
+		c.convertObject(schema, result, path)
+	case genai.TypeArray:
+		c.convertItems(schema, result, path)
+	}
+
+	c.convertEnum(schema, result, path)
+	c.convertFormat(schema, result)
+	addDescriptionHints(schema, result)
+
 	return result
 }
 
-// convertJSONSchemaToGenAISchema converts a JSON schema to Gemini schema
-func convertJSONSchemaToGenAISchema(params map[string]interface{}) *genai.Schema {
-	genaiSchema := &genai.Schema{
-		Type: genai.TypeObject,
+// convertType maps "type", which may be a list such as ["string","null"], and infers it when missing
+func (c *schemaConverter) convertType(schema map[string]any, result *genai.Schema, path string) genai.Type {
+	var types []string
+	switch t := schema["type"].(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+	case nil:
+		return inferJSONType(schema)
+	default:
+		c.fail(path, "type must be a string or a list of strings")
+		return genai.TypeString
+	}
+
+	nonNull := make([]string, 0, len(types))
+	for _, t := range types {
+		if t == "null" {
+			result.Nullable = true
+		} else {
+			nonNull = append(nonNull, t)
+		}
 	}
 
-	// Extract required fields
-	if required, ok := params["required"].([]interface{}); ok {
-		genaiSchema.Required = make([]string, 0, len(required))
+	switch len(nonNull) {
+	case 0:
+		c.fail(path, "type null has no Gemini equivalent")
+		return genai.TypeString
+	case 1:
+		t := convertJSONTypeToGenAIType(nonNull[0])
+		if t == genai.TypeUnspecified {
+			c.fail(path, "unknown type %q", nonNull[0])
+			return genai.TypeString
+		}
+		return t
+	default:
+		c.fail(path, "union type %v has no Gemini equivalent", nonNull)
+		return genai.TypeString
+	}
+}
+
+func (c *schemaConverter) convertObject(schema map[string]any, result *genai.Schema, path string) {
+	if properties, ok := schema["properties"].(map[string]any); ok {
+		result.Properties = make(map[string]*genai.Schema, len(properties))
+		for name, prop := range properties {
+			propMap, ok := prop.(map[string]any)
+			if !ok {
+				c.fail(path+".properties."+name, "property schema must be an object")
+				continue
+			}
+			result.Properties[name] = c.convert(propMap, path+".properties."+name)
+		}
+	}
+
+	// A boolean additionalProperties only allows or forbids other keys, output with the declared
+	// properties is valid either way. Schemas for the other keys describe maps, which Gemini cannot
+	// express, so they are hints next to declared properties and an error without them.
+	for _, keyword := range []string{"additionalProperties", "patternProperties"} {
+		value, ok := schema[keyword]
+		if !ok {
+			continue
+		}
+		if _, ok := value.(bool); ok {
+			continue
+		}
+		if len(result.Properties) == 0 {
+			c.fail(path, "%s without properties describes a map, which has no Gemini equivalent", keyword)
+			continue
+		}
+		hint, _ := json.Marshal(value)
+		addDescriptionHint(result, fmt.Sprintf("%s: %s", keyword, hint))
+	}
+
+	if required, ok := schema["required"].([]any); ok {
+		result.Required = make([]string, 0, len(required))
 		for _, r := range required {
 			if s, ok := r.(string); ok {
-				genaiSchema.Required = append(genaiSchema.Required, s)
+				result.Required = append(result.Required, s)
 			}
 		}
 	}
+}
 
-	// Extract properties
-	if properties, ok := params["properties"].(map[string]interface{}); ok {
-		genaiSchema.Properties = make(map[string]*genai.Schema, len(properties))
-		for name, prop := range properties {
-			if propMap, ok := prop.(map[string]interface{}); ok {
-				genaiSchema.Properties[name] = convertPropertyToGenAISchema(propMap)
-			}
+func (c *schemaConverter) convertItems(schema map[string]any, result *genai.Schema, path string) {
+	switch items := schema["items"].(type) {
+	case map[string]any:
+		result.Items = c.convert(items, path+".items")
+	case []any:
+		c.fail(path, "tuple items have no Gemini equivalent")
+	case nil:
+		if _, ok := schema["prefixItems"]; ok {
+			c.fail(path, "prefixItems has no Gemini equivalent")
+		}
+		// Gemini requires an item type, unconstrained arrays become arrays of strings
+		result.Items = &genai.Schema{Type: genai.TypeString}
+	}
+}
+
+// convertEnum maps enum and const. Gemini only supports string enums, so values of
+// other types are listed in the description instead.
+func (c *schemaConverter) convertEnum(schema map[string]any, result *genai.Schema, path string) {
+	values, ok := schema["enum"].([]any)
+	if !ok {
+		if constValue, exists := schema["const"]; exists {
+			values = []any{constValue}
+		} else {
+			return
+		}
+	}
+
+	if result.Type != genai.TypeString {
+		addDescriptionHint(result, "allowed values: "+formatJSONValues(values))
+		return
+	}
+
+	result.Enum = make([]string, 0, len(values))
+	for _, v := range values {
+		switch s := v.(type) {
+		case string:
+			result.Enum = append(result.Enum, s)
+		case nil:
+			result.Nullable = true
+		default:
+			c.fail(path, "enum value %v is not a string", v)
 		}
 	}
+	result.Format = "enum"
+}
 
-	return genaiSchema
+func (c *schemaConverter) convertFormat(schema map[string]any, result *genai.Schema) {
+	format, ok := schema["format"].(string)
+	if !ok || result.Format != "" {
+		return
+	}
+	if supportedSchemaFormats[result.Type][format] {
+		result.Format = format
+		return
+	}
+	addDescriptionHint(result, "format: "+format)
 }
 
-// convertPropertyToGenAISchema converts a property to Gemini schema
-func convertPropertyToGenAISchema(prop map[string]interface{}) *genai.Schema {
-	schema := &genai.Schema{}
+// convertRef inlines a local reference. Gemini schemas cannot be recursive and an object without
+// properties is rejected upstream, so a reference cycle is reported.
+func (c *schemaConverter) convertRef(ref string, schema map[string]any, path string) *genai.Schema {
+	if c.resolving[ref] {
+		c.fail(path, "recursive $ref %s has no Gemini equivalent", ref)
+		return &genai.Schema{Type: genai.TypeString}
+	}
 
-	// Set type
-	if t, ok := prop["type"].(string); ok {
-		schema.Type = convertJSONTypeToGenAIType(t)
+	resolved, err := resolveSchemaRef(ref, c.root)
+	if err != nil {
+		c.fail(path, "%v", err)
+		return &genai.Schema{Type: genai.TypeString}
 	}
 
-	// Set description
-	if desc, ok := prop["description"].(string); ok {
-		schema.Description = desc
+	c.resolving[ref] = true
+	defer delete(c.resolving, ref)
+
+	result := c.convert(resolved, path)
+	// Keywords next to $ref, such as a description, override the referenced schema
+	if desc, ok := schema["description"].(string); ok {
+		result.Description = desc
 	}
+	return result
+}
 
-	// Set enum values
-	if enum, ok := prop["enum"].([]interface{}); ok {
-		schema.Enum = make([]string, 0, len(enum))
-		for _, e := range enum {
-			switch v := e.(type) {
-			case string:
-				schema.Enum = append(schema.Enum, v)
-			default:
-				schema.Enum = append(schema.Enum, fmt.Sprintf("%v", v))
-			}
+// convertUnion handles anyOf and oneOf. A null option makes the schema nullable and a single
+// remaining option is used as is, real unions cannot be expressed.
+func (c *schemaConverter) convertUnion(keyword string, options []any, schema map[string]any, path string) *genai.Schema {
+	var remaining []map[string]any
+	nullable := false
+	for _, option := range options {
+		optionMap, ok := option.(map[string]any)
+		if !ok {
+			c.fail(path, "%s options must be schemas", keyword)
+			continue
+		}
+		if t, _ := optionMap["type"].(string); t == "null" && len(optionMap) == 1 {
+			nullable = true
+			continue
 		}
+		remaining = append(remaining, optionMap)
 	}
 
-	// Handle items for array type
-	if schema.Type == genai.TypeArray {
-		if items, ok := prop["items"].(map[string]interface{}); ok {
-			schema.Items = convertPropertyToGenAISchema(items)
+	if len(remaining) != 1 {
+		c.fail(path, "%s with %d alternatives has no Gemini equivalent", keyword, len(remaining))
+		return &genai.Schema{Type: genai.TypeString}
+	}
+
+	result := c.convert(remaining[0], path+"."+keyword)
+	result.Nullable = result.Nullable || nullable
+	if desc, ok := schema["description"].(string); ok {
+		result.Description = desc
+	}
+	return result
+}
+
+// convertAllOf merges the object schemas of allOf into one object
+func (c *schemaConverter) convertAllOf(schema map[string]any, path string) *genai.Schema {
+	parts, ok := schema["allOf"].([]any)
+	if !ok {
+		c.fail(path, "allOf must be a list of schemas")
+		return &genai.Schema{Type: genai.TypeString}
+	}
+
+	merged := &genai.Schema{}
+	for i, part := range parts {
+		partMap, ok := part.(map[string]any)
+		if !ok {
+			c.fail(path, "allOf options must be schemas")
+			continue
+		}
+
+		converted := c.convert(partMap, fmt.Sprintf("%s.allOf[%d]", path, i))
+		if len(parts) == 1 {
+			merged = converted
+			break
+		}
+		if converted.Type != genai.TypeObject {
+			c.fail(path, "allOf can only combine object schemas")
+			continue
+		}
+
+		merged.Type = genai.TypeObject
+		if merged.Properties == nil {
+			merged.Properties = map[string]*genai.Schema{}
+		}
+		for name, prop := range converted.Properties {
+			merged.Properties[name] = prop
+		}
+		merged.Required = append(merged.Required, converted.Required...)
+		if merged.Description == "" {
+			merged.Description = converted.Description
 		}
 	}
 
-	// Handle properties for object type
-	if schema.Type == genai.TypeObject {
-		if properties, ok := prop["properties"].(map[string]interface{}); ok {
-			schema.Properties = make(map[string]*genai.Schema, len(properties))
-			for name, p := range properties {
-				if propMap, ok := p.(map[string]interface{}); ok {
-					schema.Properties[name] = convertPropertyToGenAISchema(propMap)
-				}
-			}
+	if desc, ok := schema["description"].(string); ok {
+		merged.Description = desc
+	}
+	if merged.Type == genai.TypeUnspecified {
+		merged.Type = genai.TypeObject
+	}
+	return merged
+}
+
+// inferJSONType guesses the type of a schema without "type", unconstrained values become strings
+func inferJSONType(schema map[string]any) genai.Type {
+	switch {
+	case schema["properties"] != nil, schema["patternProperties"] != nil:
+		return genai.TypeObject
+	case schema["items"] != nil:
+		return genai.TypeArray
+	}
+	if _, ok := schema["additionalProperties"].(map[string]any); ok {
+		return genai.TypeObject
+	}
+
+	if c, ok := schema["const"]; ok {
+		return jsonValueType(c)
+	}
+	if enum, ok := schema["enum"].([]any); ok && len(enum) > 0 {
+		return jsonValueType(enum[0])
+	}
+	return genai.TypeString
+}
+
+func jsonValueType(v any) genai.Type {
+	switch n := v.(type) {
+	case bool:
+		return genai.TypeBoolean
+	case float64:
+		if n == float64(int64(n)) {
+			return genai.TypeInteger
 		}
+		return genai.TypeNumber
+	default:
+		return genai.TypeString
+	}
+}
 
-		// Extract required fields for nested objects
-		if required, ok := prop["required"].([]interface{}); ok {
-			schema.Required = make([]string, 0, len(required))
-			for _, r := range required {
-				if s, ok := r.(string); ok {
-					schema.Required = append(schema.Required, s)
-				}
-			}
+func isDescribedKeyword(keyword string) bool {
+	for _, k := range describedSchemaKeywords {
+		if k == keyword {
+			return true
 		}
 	}
+	return false
+}
 
-	return schema
+// addDescriptionHints appends constraints Gemini cannot enforce to the description, so the model still sees them
+func addDescriptionHints(schema map[string]any, result *genai.Schema) {
+	for _, keyword := range describedSchemaKeywords {
+		if v, ok := schema[keyword]; ok {
+			addDescriptionHint(result, fmt.Sprintf("%s: %v", keyword, v))
+		}
+	}
+}
+
+func addDescriptionHint(result *genai.Schema, hint string) {
+	if result.Description == "" {
+		result.Description = "(" + hint + ")"
+		return
+	}
+	result.Description += " (" + hint + ")"
+}
+
+func formatJSONValues(values []any) string {
+	formatted := make([]string, 0, len(values))
+	for _, v := range values {
+		b, _ := json.Marshal(v)
+		formatted = append(formatted, string(b))
+	}
+	sort.Strings(formatted)
+	return strings.Join(formatted, ", ")
 }
 
 // convertJSONTypeToGenAIType converts JSON schema type to Gemini type
@@ -0,0 +1,112 @@
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func parseSchema(t *testing.T, raw string) map[string]any {
+	t.Helper()
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+// conversionIssues converts raw and returns the reported issues joined together
+func conversionIssues(t *testing.T, raw string) string {
+	t.Helper()
+	_, err := convertJSONSchemaToGenAISchema(parseSchema(t, raw))
+	if err == nil {
+		return ""
+	}
+	var convErr *SchemaConversionError
+	if !errors.As(err, &convErr) {
+		t.Fatalf("unexpected error type %T: %v", err, err)
+	}
+	return strings.Join(convErr.Issues, "; ")
+}
+
+func TestConvertSchemaRejectsRecursiveRef(t *testing.T) {
+	for name, raw := range map[string]string{
+		"tree node": `{"$defs":{"Node":{"type":"object","properties":{
+			"value":{"type":"string"},
+			"children":{"type":"array","items":{"$ref":"#/$defs/Node"}}}}},
+			"$ref":"#/$defs/Node"}`,
+		"linked list": `{"$defs":{"Node":{"type":"object","properties":{
+			"value":{"type":"integer"},"next":{"$ref":"#/$defs/Node"}}}},
+			"type":"object","properties":{"head":{"$ref":"#/$defs/Node"}}}`,
+		"ref only cycle": `{"$defs":{"A":{"$ref":"#/$defs/B"},"B":{"$ref":"#/$defs/A"}},"$ref":"#/$defs/A"}`,
+	} {
+		if issues := conversionIssues(t, raw); !strings.Contains(issues, "recursive $ref #/$defs/") {
+			t.Errorf("%s: recursive $ref was not reported, issues %q", name, issues)
+		}
+	}
+}
+
+func TestConvertSchemaInlinesRepeatedRef(t *testing.T) {
+	// The same definition used twice is not a cycle
+	raw := `{"$defs":{"Point":{"type":"object","properties":{"x":{"type":"number"}}}},
+		"type":"object","properties":{"from":{"$ref":"#/$defs/Point"},"to":{"$ref":"#/$defs/Point"}}}`
+	schema, err := convertJSONSchemaToGenAISchema(parseSchema(t, raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"from", "to"} {
+		if prop := schema.Properties[name]; prop == nil || prop.Properties["x"] == nil {
+			t.Errorf("property %s was not inlined: %+v", name, prop)
+		}
+	}
+}
+
+func TestConvertSchemaAdditionalProperties(t *testing.T) {
+	if issues := conversionIssues(t, `{"type":"object","additionalProperties":{"type":"string"}}`); !strings.Contains(issues, "additionalProperties") {
+		t.Errorf("map schema was not reported, issues %q", issues)
+	}
+	if issues := conversionIssues(t, `{"type":"object","patternProperties":{"^x-":{"type":"string"}}}`); !strings.Contains(issues, "patternProperties") {
+		t.Errorf("pattern map schema was not reported, issues %q", issues)
+	}
+
+	schema, err := convertJSONSchemaToGenAISchema(parseSchema(t,
+		`{"type":"object","properties":{"name":{"type":"string"}},"additionalProperties":false}`))
+	if err != nil {
+		t.Fatalf("boolean additionalProperties: %v", err)
+	}
+	if schema.Type != genai.TypeObject || schema.Properties["name"] == nil {
+		t.Errorf("unexpected schema %+v", schema)
+	}
+
+	schema, err = convertJSONSchemaToGenAISchema(parseSchema(t,
+		`{"type":"object","properties":{"name":{"type":"string"}},"additionalProperties":{"type":"integer"}}`))
+	if err != nil {
+		t.Fatalf("additionalProperties next to properties: %v", err)
+	}
+	if !strings.Contains(schema.Description, `additionalProperties: {"type":"integer"}`) {
+		t.Errorf("additionalProperties hint missing from %q", schema.Description)
+	}
+}
+
+func TestConvertToolsRejectsRecursiveParameters(t *testing.T) {
+	tools := []openai.Tool{{
+		Type: openai.ToolTypeFunction,
+		Function: &openai.FunctionDefinition{
+			Name: "save_tree",
+			Parameters: parseSchema(t, `{"type":"object","properties":{"root":{"$ref":"#/$defs/Node"}},
+				"$defs":{"Node":{"type":"object","properties":{"children":{"type":"array","items":{"$ref":"#/$defs/Node"}}}}}}`),
+		},
+	}}
+
+	req := &ChatCompletionRequest{Tools: tools}
+	req.Messages = []ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: json.RawMessage(`"hi"`)}}
+	_, err := req.ToGenaiMessages(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "tool save_tree") {
+		t.Fatalf("recursive tool parameters were not rejected: %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+package breaker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+type State string
+
+const (
+	StateClosed   State = "closed"
+	StateOpen     State = "open"
+	StateHalfOpen State = "half-open"
+)
+
+// Config controls when a circuit opens and how it recovers
+type Config struct {
+	Enabled          bool
+	Window           time.Duration
+	MinRequests      int
+	ErrorRate        float64
+	SlowCall         time.Duration
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+	// IdleTTL is how long an unused breaker is kept, 0 keeps breakers forever
+	IdleTTL time.Duration
+}
+
+// ConfigFromEnv reads the circuit breaker configuration from the environment
+func ConfigFromEnv() Config {
+	return Config{
+		Enabled:          util.GetEnvBool("CIRCUIT_BREAKER", false),
+		Window:           util.GetEnvDuration("CIRCUIT_BREAKER_WINDOW", time.Minute),
+		MinRequests:      util.GetEnvInt("CIRCUIT_BREAKER_MIN_REQUESTS", 10),
+		ErrorRate:        util.GetEnvFloat("CIRCUIT_BREAKER_ERROR_RATE", 0.5),
+		SlowCall:         util.GetEnvDuration("CIRCUIT_BREAKER_SLOW_CALL", 30*time.Second),
+		OpenDuration:     util.GetEnvDuration("CIRCUIT_BREAKER_OPEN_DURATION", 30*time.Second),
+		HalfOpenRequests: util.GetEnvInt("CIRCUIT_BREAKER_HALF_OPEN_REQUESTS", 1),
+		IdleTTL:          util.GetEnvDuration("CIRCUIT_BREAKER_IDLE_TTL", 30*time.Minute),
+	}
+}
+
+type outcome struct {
+	at      time.Time
+	failure bool
+}
+
+// Breaker tracks the recent outcomes of one upstream key and model pair
+type Breaker struct {
+	mu       sync.Mutex
+	cfg      Config
+	state    State
+	outcomes []outcome
+	openedAt time.Time
+	probes   int
+	usedAt   time.Time
+}
+
+func newBreaker(cfg Config) *Breaker {
+	return &Breaker{cfg: cfg, state: StateClosed, usedAt: time.Now()}
+}
+
+// Allow reports whether a request may be sent upstream
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.usedAt = time.Now()
+
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.openedAt) < b.cfg.OpenDuration {
+			return false
+		}
+		b.state = StateHalfOpen
+		b.probes = 0
+		fallthrough
+	case StateHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return false
+		}
+		b.probes++
+		return true
+	default:
+		return true
+	}
+}
+
+// Cancel releases a half-open probe slot for a request that ended without an upstream outcome
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// Record stores the outcome of a request, calls slower than the configured limit count as failures
+func (b *Breaker) Record(failure bool, latency time.Duration) {
+	if b.cfg.SlowCall > 0 && latency > b.cfg.SlowCall {
+		failure = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == StateHalfOpen {
+		if failure {
+			b.trip(now)
+		} else {
+			b.state = StateClosed
+			b.outcomes = nil
+		}
+		return
+	}
+
+	b.outcomes = append(b.prune(now), outcome{at: now, failure: failure})
+	if b.state == StateClosed && len(b.outcomes) >= b.cfg.MinRequests && b.errorRate() >= b.cfg.ErrorRate {
+		b.trip(now)
+	}
+}
+
+func (b *Breaker) trip(now time.Time) {
+	b.state = StateOpen
+	b.openedAt = now
+	b.outcomes = nil
+}
+
+// prune drops outcomes outside the rolling window, the caller must hold the lock
+func (b *Breaker) prune(now time.Time) []outcome {
+	cutoff := now.Add(-b.cfg.Window)
+	i := 0
+	for i < len(b.outcomes) && b.outcomes[i].at.Before(cutoff) {
+		i++
+	}
+	return b.outcomes[i:]
+}
+
+func (b *Breaker) errorRate() float64 {
+	if len(b.outcomes) == 0 {
+		return 0
+	}
+	failures := 0
+	for _, o := range b.outcomes {
+		if o.failure {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(b.outcomes))
+}
+
+// Status is a snapshot of a breaker for the status endpoint
+type Status struct {
+	KeyID     string    `json:"key_id"`
+	Model     string    `json:"model"`
+	State     State     `json:"state"`
+	Requests  int       `json:"requests"`
+	ErrorRate float64   `json:"error_rate"`
+	OpenedAt  time.Time `json:"opened_at,omitempty"`
+}
+
+type breakerKey struct {
+	keyID string
+	model string
+}
+
+// Registry holds one breaker per upstream key and model
+type Registry struct {
+	mu        sync.Mutex
+	cfg       Config
+	breakers  map[breakerKey]*Breaker
+	lastSweep time.Time
+}
+
+func NewRegistry(cfg Config) *Registry {
+	return &Registry{
+		cfg:      cfg,
+		breakers: make(map[breakerKey]*Breaker),
+	}
+}
+
+// Config returns the configuration shared by all breakers
+func (r *Registry) Config() Config {
+	return r.cfg
+}
+
+// Enabled reports whether circuit breaking is turned on
+func (r *Registry) Enabled() bool {
+	return r.cfg.Enabled
+}
+
+// Get returns the breaker for a key and model, creating it on first use
+func (r *Registry) Get(keyID, model string) *Breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.evictIdle(time.Now())
+
+	k := breakerKey{keyID: keyID, model: model}
+	b, ok := r.breakers[k]
+	if !ok {
+		b = newBreaker(r.cfg)
+		r.breakers[k] = b
+	}
+	return b
+}
+
+// evictIdle drops breakers unused for IdleTTL, so keys that are never seen again do not accumulate.
+// Open circuits are kept until they would half-open. The caller must hold the lock.
+func (r *Registry) evictIdle(now time.Time) {
+	if r.cfg.IdleTTL <= 0 || now.Sub(r.lastSweep) < sweepInterval(r.cfg.IdleTTL) {
+		return
+	}
+	r.lastSweep = now
+
+	for k, b := range r.breakers {
+		b.mu.Lock()
+		idle := now.Sub(b.usedAt) >= r.cfg.IdleTTL &&
+			(b.state != StateOpen || now.Sub(b.openedAt) >= b.cfg.OpenDuration)
+		b.mu.Unlock()
+		if idle {
+			delete(r.breakers, k)
+		}
+	}
+}
+
+func sweepInterval(idleTTL time.Duration) time.Duration {
+	if idleTTL < time.Minute {
+		return idleTTL
+	}
+	return time.Minute
+}
+
+// Statuses returns a snapshot of every known breaker
+func (r *Registry) Statuses() []Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]Status, 0, len(r.breakers))
+	for k, b := range r.breakers {
+		b.mu.Lock()
+		state := b.state
+		if state == StateOpen && now.Sub(b.openedAt) >= b.cfg.OpenDuration {
+			state = StateHalfOpen
+		}
+		b.outcomes = b.prune(now)
+		status := Status{
+			KeyID:     k.keyID,
+			Model:     k.model,
+			State:     state,
+			Requests:  len(b.outcomes),
+			ErrorRate: b.errorRate(),
+		}
+		if state != StateClosed {
+			status.OpenedAt = b.openedAt
+		}
+		b.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].KeyID != statuses[j].KeyID {
+			return statuses[i].KeyID < statuses[j].KeyID
+		}
+		return statuses[i].Model < statuses[j].Model
+	})
+	return statuses
+}
+
+// OpenKeys counts the keys with at least one breaker among those include accepts, and how many
+// of them have every circuit open
+func (r *Registry) OpenKeys(include func(keyID string) bool) (open, total int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	allOpen := map[string]bool{}
+	for k, b := range r.breakers {
+		if !include(k.keyID) {
+			continue
+		}
+		b.mu.Lock()
+		isOpen := b.state == StateOpen && now.Sub(b.openedAt) < b.cfg.OpenDuration
+		b.mu.Unlock()
+
+		if prev, seen := allOpen[k.keyID]; seen {
+			allOpen[k.keyID] = prev && isOpen
+		} else {
+			allOpen[k.keyID] = isOpen
+		}
+	}
+
+	for _, isOpen := range allOpen {
+		if isOpen {
+			open++
+		}
+	}
+	return open, len(allOpen)
+}
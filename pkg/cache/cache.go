@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+const (
+	BackendMemory = "memory"
+	BackendDisk   = "disk"
+)
+
+// Cache stores serialized responses keyed by a request hash
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Flush()
+}
+
+// Config describes the cache backend and its limits
+type Config struct {
+	Backend    string
+	TTL        time.Duration
+	MaxEntries int
+	Dir        string
+	// SweepInterval is how often the disk backend removes expired entries
+	SweepInterval time.Duration
+}
+
+// ConfigFromEnv reads the cache configuration from the environment
+func ConfigFromEnv() Config {
+	return Config{
+		Backend:    util.GetEnvString("RESPONSE_CACHE", ""),
+		TTL:        util.GetEnvDuration("RESPONSE_CACHE_TTL", time.Hour),
+		MaxEntries: util.GetEnvInt("RESPONSE_CACHE_SIZE", 1000),
+		Dir: util.GetEnvString("RESPONSE_CACHE_DIR",
+			filepath.Join(os.TempDir(), "gemini-openai-proxy-cache")),
+		SweepInterval: util.GetEnvDuration("RESPONSE_CACHE_SWEEP_INTERVAL", 10*time.Minute),
+	}
+}
+
+// New creates a cache for the configured backend, it returns nil when caching is disabled
+func New(cfg Config) Cache {
+	switch cfg.Backend {
+	case BackendMemory:
+		return NewMemoryCache(cfg.MaxEntries)
+	case BackendDisk:
+		c, err := NewDiskCache(cfg.Dir, cfg.MaxEntries, cfg.SweepInterval)
+		if err != nil {
+			util.ReportConfigError("Failed to create disk cache in "+cfg.Dir, err)
+			return nil
+		}
+		return c
+	case "":
+		return nil
+	default:
+		util.ReportConfigError("Unknown cache backend, caching disabled", fmt.Errorf("%q", cfg.Backend))
+		return nil
+	}
+}
+
+// Key returns a stable hash for any JSON serializable value
+func Key(parts ...any) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, part := range parts {
+		// encoding/json sorts map keys, so equal values always hash the same
+		_ = enc.Encode(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
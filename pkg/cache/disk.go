@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type diskEntry struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Value     []byte    `json:"value"`
+}
+
+// DiskCache stores each entry as a JSON file named after its key. The file modification time
+// tracks the last use, so the least recently used files are removed first when the cache is full.
+type DiskCache struct {
+	dir        string
+	maxEntries int
+
+	mu      sync.Mutex
+	entries int // Files in dir, counted again by every prune
+}
+
+// NewDiskCache creates a cache in dir holding up to maxEntries entries. Expired entries are
+// removed every sweepInterval, or only when read if it is 0.
+func NewDiskCache(dir string, maxEntries int, sweepInterval time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+
+	c := &DiskCache{dir: dir, maxEntries: maxEntries}
+	c.prune(maxEntries)
+	if sweepInterval > 0 {
+		go c.sweep(sweepInterval)
+	}
+	return c, nil
+}
+
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	entry, ok := c.read(c.path(key))
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(c.path(key), now, now)
+	return entry.Value, true
+}
+
+func (c *DiskCache) Set(key string, value []byte, ttl time.Duration) {
+	entry := diskEntry{Value: value}
+	if ttl > 0 {
+		entry.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	// Write to a temp file first so readers never see a partial entry
+	tmp, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return
+	}
+	tmp.Close()
+
+	_, statErr := os.Stat(c.path(key))
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		_ = os.Remove(tmp.Name())
+		return
+	}
+	if statErr == nil {
+		// Replaced an existing entry
+		return
+	}
+
+	c.mu.Lock()
+	c.entries++
+	full := c.entries > c.maxEntries
+	c.mu.Unlock()
+	if full {
+		// Pruning below the limit leaves room, so the directory is not listed on every Set
+		c.prune(c.maxEntries * 9 / 10)
+	}
+}
+
+func (c *DiskCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".json" {
+			_ = os.Remove(filepath.Join(c.dir, entry.Name()))
+		}
+	}
+	c.entries = 0
+}
+
+// read returns the entry stored in path, removing it when it is corrupt or expired
+func (c *DiskCache) read(path string) (*diskEntry, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	var entry diskEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		_ = os.Remove(path)
+		return nil, false
+	}
+
+	if !entry.ExpiresAt.IsZero() && time.Now().After(entry.ExpiresAt) {
+		_ = os.Remove(path)
+		return nil, false
+	}
+	return &entry, true
+}
+
+// prune removes expired entries and temp files left by interrupted writes, then the least
+// recently used entries until at most limit are left
+func (c *DiskCache) prune(limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	type file struct {
+		path    string
+		modTime time.Time
+	}
+	var files []file
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(c.dir, dirEntry.Name())
+
+		if strings.HasPrefix(dirEntry.Name(), "tmp-") {
+			if time.Since(info.ModTime()) > time.Hour {
+				_ = os.Remove(path)
+			}
+			continue
+		}
+		if filepath.Ext(dirEntry.Name()) != ".json" {
+			continue
+		}
+		if _, ok := c.read(path); ok {
+			files = append(files, file{path: path, modTime: info.ModTime()})
+		}
+	}
+
+	if len(files) > limit {
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+		for _, f := range files[:len(files)-limit] {
+			_ = os.Remove(f.path)
+		}
+		files = files[len(files)-limit:]
+	}
+	c.entries = len(files)
+}
+
+func (c *DiskCache) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.prune(c.maxEntries)
+	}
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
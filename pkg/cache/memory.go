@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// MemoryCache is an in-memory LRU cache with per entry expiry
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int // 0 when only the number of entries is bounded
+	bytes      int // Total size of the values
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return NewMemoryCacheWithMaxBytes(maxEntries, 0)
+}
+
+// NewMemoryCacheWithMaxBytes creates a cache that also keeps the total size of its values under
+// maxBytes, values larger than maxBytes are not cached
+func NewMemoryCacheWithMaxBytes(maxEntries, maxBytes int) *MemoryCache {
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*memoryEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *MemoryCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	if c.maxBytes > 0 && len(value) > c.maxBytes {
+		if elem, ok := c.items[key]; ok {
+			c.removeElement(elem)
+		}
+		return
+	}
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*memoryEntry)
+		c.bytes += len(value) - len(entry.value)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.ll.MoveToFront(elem)
+	} else {
+		c.items[key] = c.ll.PushFront(&memoryEntry{key: key, value: value, expiresAt: expiresAt})
+		c.bytes += len(value)
+	}
+
+	for c.ll.Len() > c.maxEntries || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *MemoryCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+}
+
+func (c *MemoryCache) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	entry := elem.Value.(*memoryEntry)
+	delete(c.items, entry.key)
+	c.bytes -= len(entry.value)
+}
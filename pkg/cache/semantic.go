@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+const (
+	EvictionLRU  = "lru"
+	EvictionFIFO = "fifo"
+
+	ScopeModel  = "model"
+	ScopeTenant = "tenant"
+)
+
+// SemanticConfig describes the semantic cache behaviour
+type SemanticConfig struct {
+	Enabled        bool
+	Threshold      float64
+	Scope          []string
+	Eviction       string
+	MaxEntries     int
+	TTL            time.Duration
+	EmbeddingModel string
+}
+
+// SemanticConfigFromEnv reads the semantic cache configuration from the environment
+func SemanticConfigFromEnv() SemanticConfig {
+	scope := []string{}
+	for _, s := range strings.Split(util.GetEnvString("SEMANTIC_CACHE_SCOPE", "model,tenant"), ",") {
+		if s = strings.TrimSpace(s); s == ScopeModel || s == ScopeTenant {
+			scope = append(scope, s)
+		}
+	}
+
+	return SemanticConfig{
+		Enabled:        util.GetEnvBool("SEMANTIC_CACHE", false),
+		Threshold:      util.GetEnvFloat("SEMANTIC_CACHE_THRESHOLD", 0.95),
+		Scope:          scope,
+		Eviction:       util.GetEnvString("SEMANTIC_CACHE_EVICTION", EvictionLRU),
+		MaxEntries:     util.GetEnvInt("SEMANTIC_CACHE_SIZE", 1000),
+		TTL:            util.GetEnvDuration("SEMANTIC_CACHE_TTL", 24*time.Hour),
+		EmbeddingModel: util.GetEnvString("SEMANTIC_CACHE_EMBEDDING_MODEL", "text-embedding-004"),
+	}
+}
+
+// ScopeKey builds the index partition for a request according to the configured scope.
+// context identifies everything in the request except the text being compared.
+func (cfg SemanticConfig) ScopeKey(kind, model, tenant, context string) string {
+	parts := []string{kind, "context=" + context}
+	for _, s := range cfg.Scope {
+		switch s {
+		case ScopeModel:
+			parts = append(parts, "model="+model)
+		case ScopeTenant:
+			parts = append(parts, "tenant="+tenant)
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+type semanticEntry struct {
+	vector    []float32
+	norm      float64
+	value     []byte
+	createdAt time.Time
+	usedAt    time.Time
+}
+
+// SemanticIndex is a brute force in-memory vector index partitioned by scope
+type SemanticIndex struct {
+	mu     sync.Mutex
+	cfg    SemanticConfig
+	scopes map[string][]*semanticEntry
+}
+
+func NewSemanticIndex(cfg SemanticConfig) *SemanticIndex {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = 1000
+	}
+	return &SemanticIndex{
+		cfg:    cfg,
+		scopes: make(map[string][]*semanticEntry),
+	}
+}
+
+// Search returns the stored value most similar to vector if its cosine similarity reaches the threshold
+func (idx *SemanticIndex) Search(scope string, vector []float32) ([]byte, float64, bool) {
+	norm := vectorNorm(vector)
+	if norm == 0 {
+		return nil, 0, false
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.expire(scope)
+
+	var best *semanticEntry
+	bestScore := -1.0
+	for _, entry := range idx.scopes[scope] {
+		if len(entry.vector) != len(vector) {
+			continue
+		}
+		score := dot(entry.vector, vector) / (entry.norm * norm)
+		if score > bestScore {
+			best, bestScore = entry, score
+		}
+	}
+
+	if best == nil || bestScore < idx.cfg.Threshold {
+		return nil, bestScore, false
+	}
+
+	best.usedAt = time.Now()
+	return best.value, bestScore, true
+}
+
+// Add stores a value for vector, evicting an entry when the scope is full
+func (idx *SemanticIndex) Add(scope string, vector []float32, value []byte) {
+	norm := vectorNorm(vector)
+	if norm == 0 {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.expire(scope)
+
+	now := time.Now()
+	entries := append(idx.scopes[scope], &semanticEntry{
+		vector:    vector,
+		norm:      norm,
+		value:     value,
+		createdAt: now,
+		usedAt:    now,
+	})
+
+	for len(entries) > idx.cfg.MaxEntries {
+		victim := 0
+		for i, entry := range entries {
+			if idx.cfg.Eviction == EvictionFIFO {
+				if entry.createdAt.Before(entries[victim].createdAt) {
+					victim = i
+				}
+			} else if entry.usedAt.Before(entries[victim].usedAt) {
+				victim = i
+			}
+		}
+		entries = append(entries[:victim], entries[victim+1:]...)
+	}
+
+	idx.scopes[scope] = entries
+}
+
+func (idx *SemanticIndex) Flush() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.scopes = make(map[string][]*semanticEntry)
+}
+
+// expire drops entries older than the TTL, the caller must hold the lock
+func (idx *SemanticIndex) expire(scope string) {
+	if idx.cfg.TTL <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(-idx.cfg.TTL)
+	entries := idx.scopes[scope][:0]
+	for _, entry := range idx.scopes[scope] {
+		if entry.createdAt.After(deadline) {
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) == 0 {
+		delete(idx.scopes, scope)
+		return
+	}
+	idx.scopes[scope] = entries
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+func vectorNorm(v []float32) float64 {
+	return math.Sqrt(dot(v, v))
+}
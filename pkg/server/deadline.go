@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WriteDeadline gives every write of a response timeout to complete. Unlike http.Server.WriteTimeout
+// the time spent waiting for upstream before writing does not count, so long generations are not cut
+// off and streams only fail when the client stops reading.
+func WriteDeadline(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+
+		rc := http.NewResponseController(c.Writer)
+		// Keep-alive connections would otherwise still carry the deadline of their previous request
+		_ = rc.SetWriteDeadline(time.Time{})
+		c.Writer = &deadlineWriter{ResponseWriter: c.Writer, rc: rc, timeout: timeout}
+
+		c.Next()
+
+		// Covers the final flush of responses the handler buffered or left empty
+		_ = rc.SetWriteDeadline(time.Now().Add(timeout))
+	}
+}
+
+// deadlineWriter restarts the write deadline before each write
+type deadlineWriter struct {
+	gin.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(data []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *deadlineWriter) WriteString(s string) (int, error) {
+	w.extend()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *deadlineWriter) extend() {
+	_ = w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/zhu327/gemini-openai-proxy/pkg/util"
+)
+
+// Config describes how the HTTP server listens and times out
+type Config struct {
+	Addr              string
+	UnixSocket        string
+	TLSCertFile       string
+	TLSKeyFile        string
+	H2C               bool
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	WriteTimeout      time.Duration
+	ShutdownGrace     time.Duration
+}
+
+// ConfigFromEnv reads the server configuration from the environment, addr is the TCP address to listen on
+func ConfigFromEnv(addr string) Config {
+	return Config{
+		Addr:              addr,
+		UnixSocket:        util.GetEnvString("UNIX_SOCKET", ""),
+		TLSCertFile:       util.GetEnvString("TLS_CERT_FILE", ""),
+		TLSKeyFile:        util.GetEnvString("TLS_KEY_FILE", ""),
+		H2C:               util.GetEnvBool("H2C", false),
+		ReadHeaderTimeout: util.GetEnvDuration("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+		IdleTimeout:       util.GetEnvDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+		WriteTimeout:      util.GetEnvDuration("SERVER_WRITE_TIMEOUT", 2*time.Minute),
+		ShutdownGrace:     util.GetEnvDuration("SERVER_SHUTDOWN_GRACE", 30*time.Second),
+	}
+}
+
+// Run serves handler until SIGINT or SIGTERM, then stops accepting connections and
+// waits up to the shutdown grace period for in-flight requests and streams to finish
+func Run(handler http.Handler, cfg Config) error {
+	tlsEnabled := cfg.TLSCertFile != "" && cfg.TLSKeyFile != ""
+	if cfg.H2C && !tlsEnabled {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: cfg.IdleTimeout})
+	}
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		// The write timeout is applied per write by WriteDeadline, so waiting for upstream does not count
+	}
+
+	listener, err := listen(cfg)
+	if err != nil {
+		return err
+	}
+
+	if tlsEnabled {
+		certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errChan := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s\n", listener.Addr())
+		if tlsEnabled {
+			// Certificates come from TLSConfig.GetCertificate
+			errChan <- srv.ServeTLS(listener, "", "")
+		} else {
+			errChan <- srv.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests\n", cfg.ShutdownGrace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Graceful shutdown incomplete, closing remaining connections: %v\n", err)
+		srv.Close()
+	}
+
+	if err := <-errChan; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func listen(cfg Config) (net.Listener, error) {
+	if cfg.UnixSocket == "" {
+		return net.Listen("tcp", cfg.Addr)
+	}
+
+	// Remove a stale socket left behind by a previous process
+	if err := os.Remove(cfg.UnixSocket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", cfg.UnixSocket)
+}
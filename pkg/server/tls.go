@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval limits how often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate from disk and reloads it when the files change,
+// so renewed certificates are picked up without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) > certCheckInterval {
+		r.checkedAt = time.Now()
+		if modTime, err := r.latestModTime(); err == nil && modTime.After(r.modTime) {
+			if err := r.load(); err != nil {
+				// Keep serving the previous certificate until the new one is valid
+				log.Printf("Failed to reload TLS certificate: %v\n", err)
+			} else {
+				log.Printf("Reloaded TLS certificate from %s\n", r.certFile)
+			}
+		}
+	}
+
+	return r.cert, nil
+}
+
+// load reads the key pair, the caller must hold the lock unless r is not shared yet
+func (r *certReloader) load() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	return nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
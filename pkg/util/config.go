@@ -0,0 +1,28 @@
+package util
+
+import (
+	"log"
+	"sync"
+)
+
+var (
+	configErrorsLock sync.RWMutex
+	configErrors     []string
+)
+
+// ReportConfigError records an invalid configuration value so readiness checks can report it
+func ReportConfigError(msg string, err error) {
+	log.Printf("%s: %v\n", msg, err)
+
+	configErrorsLock.Lock()
+	defer configErrorsLock.Unlock()
+	configErrors = append(configErrors, msg+": "+err.Error())
+}
+
+// ConfigErrors returns every configuration error reported so far
+func ConfigErrors() []string {
+	configErrorsLock.RLock()
+	defer configErrorsLock.RUnlock()
+
+	return append([]string(nil), configErrors...)
+}
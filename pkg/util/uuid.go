@@ -1,6 +1,8 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"strings"
 
 	"github.com/google/uuid"
@@ -11,3 +13,9 @@ func GetUUID() string {
 	code = strings.Replace(code, "-", "", -1)
 	return code
 }
+
+// HashKey returns a short, stable identifier for an API key that is safe to log or expose
+func HashKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:8])
+}